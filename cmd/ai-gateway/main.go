@@ -4,47 +4,105 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/vitali/ai-gateway/internal/cache"
 	"github.com/vitali/ai-gateway/internal/config"
 	"github.com/vitali/ai-gateway/internal/db"
 	"github.com/vitali/ai-gateway/internal/handlers"
+	"github.com/vitali/ai-gateway/internal/token_counter"
 )
 
 func main() {
-	cfg := config.ParseFlags()
+	cfg, err := config.ParseFlags()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	for _, provider := range cfg.Providers {
+		log.Printf("Provider %s: %s (%s)", provider.Name, provider.BaseURL, provider.APIStyle)
+	}
+
+	token_counter.SetTokenizers(cfg.Tokenizers)
+	if err := token_counter.LoadEncodings(); err != nil {
+		log.Fatalf("Failed to load tokenizer encodings: %v", err)
+	}
 
-	var err error
 	db.DB, err = db.InitDB(cfg.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	log.Printf("Database initialized successfully")
 
-	isEmpty, err := db.IsModelPriceTableEmpty()
-	if err != nil {
-		log.Printf("Error checking if ModelPrice table is empty: %v", err)
-	} else if isEmpty {
-		log.Printf("ModelPrice table is empty, fetching model pricing...")
-		if err := db.FetchAndStoreModelPricing(cfg.TargetURL); err != nil {
-			log.Printf("Error fetching and storing model pricing: %v", err)
-		} else {
-			log.Printf("Model pricing fetched and stored successfully")
-		}
-	} else {
-		log.Printf("ModelPrice table already has data, skipping fetch")
+	if err := cache.Init(cfg.Cache); err != nil {
+		log.Fatalf("Failed to initialize response cache: %v", err)
+	}
+	if cache.Enabled() {
+		log.Printf("Caching responses in %s for %s", cfg.Cache.Store, cfg.Cache.TTL)
+	}
+
+	// Prices are versioned, so fetching them again only adds a version for
+	// the models whose price changed
+	refreshModelPricing(cfg.TargetURL)
+	if cfg.PricingRefresh > 0 {
+		go func() {
+			for range time.Tick(cfg.PricingRefresh) {
+				refreshModelPricing(cfg.TargetURL)
+			}
+		}()
 	}
 
 	http.HandleFunc("/", handlers.HandleLogsPage)
 
 	http.HandleFunc("/prices", handlers.HandlePricesPage)
 
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleStatusPage(w, r, cfg)
+	})
+
+	http.HandleFunc("/metrics", handlers.HandleMetrics)
+
+	http.HandleFunc("/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAdminKeys(w, r, cfg)
+	})
+
+	http.HandleFunc("/admin/keys/", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAdminKey(w, r, cfg)
+	})
+
+	http.HandleFunc("/admin/budgets", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAdminBudgets(w, r, cfg)
+	})
+
+	http.HandleFunc("/admin/budgets/", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleAdminBudget(w, r, cfg)
+	})
+
 	http.HandleFunc("/v1/messages", func(w http.ResponseWriter, r *http.Request) {
 		handlers.HandleMessages(w, r, cfg)
 	})
 
+	http.HandleFunc("/v1/messages/count_tokens", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleCountTokens(w, r, cfg)
+	})
+
+	http.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HandleChatCompletions(w, r, cfg)
+	})
+
 	http.HandleFunc("/v1/models", handlers.HandleModels)
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
 	log.Printf("Starting server on %s", addr)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
+
+// refreshModelPricing fetches model pricing from the upstream. Failures are
+// logged, as costs can still be calculated from the stored prices.
+func refreshModelPricing(targetURL string) {
+	log.Printf("Fetching model pricing...")
+	if err := db.FetchAndStoreModelPricing(targetURL); err != nil {
+		log.Printf("Error fetching and storing model pricing: %v", err)
+	} else {
+		log.Printf("Model pricing fetched and stored successfully")
+	}
+}
@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/pkoukk/tiktoken-go v0.1.7
+	github.com/pkoukk/tiktoken-go-loader v0.0.2
 	gorm.io/driver/sqlite v1.5.7
 	gorm.io/gorm v1.30.0
 )
@@ -0,0 +1,239 @@
+package breaker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker
+type State int
+
+const (
+	// Closed lets all requests through while counting failures
+	Closed State = iota
+	// Open rejects requests until the open period has passed
+	Open
+	// HalfOpen lets a single probe request through to test recovery
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// ErrOpen is returned for requests rejected by an open breaker
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Settings configures when a breaker opens and for how long. Like the retry
+// policy they can be set per provider in the providers config file.
+type Settings struct {
+	WindowSeconds int     `json:"window_seconds"` // Period over which the error rate is measured
+	MinRequests   int     `json:"min_requests"`   // Requests needed in the window before the breaker can open
+	ErrorRate     float64 `json:"error_rate"`     // Fraction of failed requests that opens the breaker, e.g. 0.5
+	OpenSeconds   int     `json:"open_seconds"`   // Time the breaker stays open before probing
+}
+
+// DefaultSettings is used for providers without breaker settings
+var DefaultSettings = Settings{
+	WindowSeconds: 60,
+	MinRequests:   10,
+	ErrorRate:     0.5,
+	OpenSeconds:   30,
+}
+
+// WithDefaults fills unset values from DefaultSettings
+func (s Settings) WithDefaults() Settings {
+	if s.WindowSeconds <= 0 {
+		s.WindowSeconds = DefaultSettings.WindowSeconds
+	}
+	if s.MinRequests <= 0 {
+		s.MinRequests = DefaultSettings.MinRequests
+	}
+	if s.ErrorRate <= 0 {
+		s.ErrorRate = DefaultSettings.ErrorRate
+	}
+	if s.OpenSeconds <= 0 {
+		s.OpenSeconds = DefaultSettings.OpenSeconds
+	}
+	return s
+}
+
+// Breaker tracks the health of one provider and model
+type Breaker struct {
+	mu       sync.Mutex
+	settings Settings
+
+	state       State
+	windowStart time.Time
+	requests    int // Requests in the current window
+	failures    int // Failed requests in the current window
+	openedAt    time.Time
+	probeAt     time.Time // When the half-open probe was let through
+
+	// Totals since startup, for metrics
+	successes int64
+	errors    int64
+	rejected  int64
+}
+
+// Status is a snapshot of a breaker for the status page and metrics
+type Status struct {
+	Provider  string
+	Model     string
+	State     State
+	Requests  int
+	Failures  int
+	OpenedAt  time.Time
+	Successes int64
+	Errors    int64
+	Rejected  int64
+}
+
+type key struct {
+	provider string
+	model    string
+}
+
+var (
+	mu       sync.Mutex
+	breakers = make(map[key]*Breaker)
+)
+
+// For returns the breaker of a provider and model, creating it with the
+// given settings on first use
+func For(provider, model string, settings Settings) *Breaker {
+	mu.Lock()
+	defer mu.Unlock()
+
+	k := key{provider: provider, model: model}
+	if b, ok := breakers[k]; ok {
+		return b
+	}
+
+	b := &Breaker{
+		settings:    settings.WithDefaults(),
+		windowStart: time.Now(),
+	}
+	breakers[k] = b
+	return b
+}
+
+// All returns the status of every breaker, sorted by provider and model
+func All() []Status {
+	mu.Lock()
+	statuses := make([]Status, 0, len(breakers))
+	for k, b := range breakers {
+		status := b.Status()
+		status.Provider = k.provider
+		status.Model = k.model
+		statuses = append(statuses, status)
+	}
+	mu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Provider != statuses[j].Provider {
+			return statuses[i].Provider < statuses[j].Provider
+		}
+		return statuses[i].Model < statuses[j].Model
+	})
+	return statuses
+}
+
+// Allow reports whether a request may be sent. Once the open period has
+// passed a single probe is let through; if its outcome is never recorded,
+// for example because the client went away, another probe is allowed after
+// the next open period.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	openPeriod := time.Duration(b.settings.OpenSeconds) * time.Second
+
+	switch b.state {
+	case Open:
+		if now.Sub(b.openedAt) < openPeriod {
+			b.rejected++
+			return false
+		}
+		b.state = HalfOpen
+		b.probeAt = now
+		return true
+	case HalfOpen:
+		if now.Sub(b.probeAt) < openPeriod {
+			b.rejected++
+			return false
+		}
+		b.probeAt = now
+		return true
+	}
+	return true
+}
+
+// Record reports the outcome of a request that Allow let through
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if success {
+		b.successes++
+	} else {
+		b.errors++
+	}
+
+	if b.state == HalfOpen {
+		if success {
+			b.state = Closed
+			b.resetWindow(now)
+		} else {
+			b.state = Open
+			b.openedAt = now
+		}
+		return
+	}
+
+	if now.Sub(b.windowStart) >= time.Duration(b.settings.WindowSeconds)*time.Second {
+		b.resetWindow(now)
+	}
+	b.requests++
+	if !success {
+		b.failures++
+	}
+
+	if b.state == Closed && b.requests >= b.settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.settings.ErrorRate {
+		b.state = Open
+		b.openedAt = now
+	}
+}
+
+// Status returns a snapshot of the breaker
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return Status{
+		State:     b.state,
+		Requests:  b.requests,
+		Failures:  b.failures,
+		OpenedAt:  b.openedAt,
+		Successes: b.successes,
+		Errors:    b.errors,
+		Rejected:  b.rejected,
+	}
+}
+
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
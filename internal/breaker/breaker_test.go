@@ -0,0 +1,113 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+var testSettings = Settings{WindowSeconds: 60, MinRequests: 4, ErrorRate: 0.5, OpenSeconds: 30}
+
+// openBreaker returns a breaker that has just opened
+func openBreaker(t *testing.T) *Breaker {
+	t.Helper()
+	b := For(t.Name(), "m", testSettings)
+	for _, success := range []bool{true, true, false, false} {
+		b.Record(success)
+	}
+	if b.Status().State != Open {
+		t.Fatalf("state %v after 2 of 4 failures, want open", b.Status().State)
+	}
+	return b
+}
+
+// elapse moves the breaker's clocks back as if d had passed
+func elapse(b *Breaker, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.windowStart = b.windowStart.Add(-d)
+	b.openedAt = b.openedAt.Add(-d)
+	b.probeAt = b.probeAt.Add(-d)
+}
+
+func TestBreakerStaysClosedBelowThresholds(t *testing.T) {
+	b := For(t.Name(), "m", testSettings)
+
+	// Too few requests to open, whatever the error rate
+	for i := 0; i < 3; i++ {
+		b.Record(false)
+	}
+	if state := b.Status().State; state != Closed {
+		t.Fatalf("state %v after 3 requests, want closed", state)
+	}
+
+	// A new window starts from zero
+	elapse(b, time.Minute)
+	for _, success := range []bool{true, true, true, false} {
+		b.Record(success)
+	}
+	status := b.Status()
+	if status.State != Closed || status.Requests != 4 || status.Failures != 1 {
+		t.Errorf("got %+v, want closed with 1 of 4 failures in the window", status)
+	}
+}
+
+func TestBreakerOpenRejects(t *testing.T) {
+	b := openBreaker(t)
+
+	if b.Allow() {
+		t.Error("open breaker let a request through")
+	}
+	if rejected := b.Status().Rejected; rejected != 1 {
+		t.Errorf("rejected %d, want 1", rejected)
+	}
+}
+
+func TestBreakerProbeSuccessCloses(t *testing.T) {
+	b := openBreaker(t)
+	elapse(b, 30*time.Second)
+
+	if !b.Allow() {
+		t.Fatal("no probe after the open period")
+	}
+	if state := b.Status().State; state != HalfOpen {
+		t.Fatalf("state %v with a probe in flight, want half-open", state)
+	}
+	if b.Allow() {
+		t.Error("second request let through while the probe is in flight")
+	}
+
+	b.Record(true)
+	status := b.Status()
+	if status.State != Closed || status.Requests != 0 || status.Failures != 0 {
+		t.Errorf("got %+v after a successful probe, want closed with a new window", status)
+	}
+	if !b.Allow() {
+		t.Error("closed breaker rejected a request")
+	}
+}
+
+func TestBreakerProbeFailureReopens(t *testing.T) {
+	b := openBreaker(t)
+	elapse(b, 30*time.Second)
+	b.Allow()
+
+	b.Record(false)
+	if state := b.Status().State; state != Open {
+		t.Fatalf("state %v after a failed probe, want open", state)
+	}
+	if b.Allow() {
+		t.Error("reopened breaker let a request through")
+	}
+}
+
+func TestBreakerUnrecordedProbe(t *testing.T) {
+	b := openBreaker(t)
+	elapse(b, 30*time.Second)
+	b.Allow()
+
+	// The probe's outcome never arrives, so another is allowed later
+	elapse(b, 30*time.Second)
+	if !b.Allow() {
+		t.Error("no new probe after an unrecorded one")
+	}
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// Header lets clients control caching per request: "force" caches a request
+// whatever its temperature and "bypass" skips the cache. Responses carry it
+// as "hit" or "miss" when the cache was consulted.
+const Header = "x-gateway-cache"
+
+// Settings configures the response cache
+type Settings struct {
+	Store         string        // "memory" or "sqlite", empty to disable the cache
+	TTL           time.Duration // How long a response is served from the cache
+	MaxEntries    int           // Oldest entries are dropped beyond this count
+	MaxEntryBytes int           // Larger responses are not cached
+}
+
+// Entry is a cached response in the format of the client that requested it
+type Entry struct {
+	Body        string
+	Usage       string
+	UsageSource string
+	Provider    string
+	CreatedAt   time.Time
+}
+
+// store keeps cache entries
+type store interface {
+	get(key string, now time.Time) (Entry, bool)
+	put(key string, entry Entry)
+}
+
+var (
+	settings Settings
+	active   store
+)
+
+// Init sets up the cache. It must be called after the database has been
+// initialized when the sqlite store is used.
+func Init(s Settings) error {
+	settings = s
+	switch s.Store {
+	case "":
+		active = nil
+	case "memory":
+		active = newMemoryStore(s.MaxEntries)
+	case "sqlite":
+		active = sqliteStore{maxEntries: s.MaxEntries}
+	default:
+		return fmt.Errorf("unknown cache store %q, use memory or sqlite", s.Store)
+	}
+	return nil
+}
+
+// Enabled reports whether the cache is in use
+func Enabled() bool {
+	return active != nil
+}
+
+// Eligible reports whether a request may be answered from the cache. Only
+// deterministic requests are cached, that is with a temperature of 0, unless
+// the client forces caching with the header.
+func Eligible(temperature *float64, header string) bool {
+	switch strings.ToLower(header) {
+	case "bypass":
+		return false
+	case "force":
+		return true
+	}
+	return temperature != nil && *temperature == 0
+}
+
+// Key returns the cache key of a request: the SHA-256 of the request as sent
+// to an OpenAI-style upstream, with everything that only affects how the
+// response is delivered removed. The client format is part of the key since
+// entries are stored as the client received them.
+func Key(requestType string, openaiReq models.OpenAIRequest) (string, error) {
+	openaiReq.Stream = false
+	openaiReq.StreamOptions = nil
+
+	canonical, err := json.Marshal(struct {
+		RequestType string               `json:"request_type"`
+		Request     models.OpenAIRequest `json:"request"`
+	}{
+		RequestType: requestType,
+		Request:     openaiReq,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error encoding request for the cache key: %v", err)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// RawKey returns the cache key of a request that is relayed to the upstream
+// unchanged: the SHA-256 of its JSON body without the stream fields. The
+// parsed request would miss fields such as thinking or metadata that the
+// upstream still acts on.
+func RawKey(requestType string, body []byte) (string, error) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", fmt.Errorf("error decoding request for the cache key: %v", err)
+	}
+	delete(request, "stream")
+	delete(request, "stream_options")
+
+	canonical, err := json.Marshal(struct {
+		RequestType string                     `json:"request_type"`
+		RawRequest  map[string]json.RawMessage `json:"raw_request"`
+	}{
+		RequestType: requestType,
+		RawRequest:  request,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error encoding request for the cache key: %v", err)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get returns the cached response for a key
+func Get(key string) (Entry, bool) {
+	if active == nil {
+		return Entry{}, false
+	}
+	return active.get(key, time.Now())
+}
+
+// Put caches a response unless it is larger than the entry size limit
+func Put(key string, entry Entry) {
+	if active == nil {
+		return
+	}
+	if settings.MaxEntryBytes > 0 && len(entry.Body) > settings.MaxEntryBytes {
+		log.Printf("Not caching response of %d bytes, above the limit of %d", len(entry.Body), settings.MaxEntryBytes)
+		return
+	}
+	entry.CreatedAt = time.Now()
+	active.put(key, entry)
+}
+
+// memoryStore is an in-memory LRU store
+type memoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // Most recently used first
+	items      map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry Entry
+}
+
+func newMemoryStore(maxEntries int) *memoryStore {
+	return &memoryStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryStore) get(key string, now time.Time) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	item := element.Value.(*memoryItem)
+	if now.Sub(item.entry.CreatedAt) >= settings.TTL {
+		m.order.Remove(element)
+		delete(m.items, key)
+		return Entry{}, false
+	}
+	m.order.MoveToFront(element)
+	return item.entry, true
+}
+
+func (m *memoryStore) put(key string, entry Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.items[key]; ok {
+		element.Value.(*memoryItem).entry = entry
+		m.order.MoveToFront(element)
+		return
+	}
+
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: entry})
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryItem).key)
+	}
+}
+
+// sqliteStore keeps entries in the gateway database, so they survive
+// restarts
+type sqliteStore struct {
+	maxEntries int
+}
+
+func (s sqliteStore) get(key string, now time.Time) (Entry, bool) {
+	cached, err := db.FindCachedResponse(key, now)
+	if err != nil {
+		log.Printf("Error reading cached response: %v", err)
+		return Entry{}, false
+	}
+	if cached == nil {
+		return Entry{}, false
+	}
+	return Entry{
+		Body:        cached.Body,
+		Usage:       cached.Usage,
+		UsageSource: cached.UsageSource,
+		Provider:    cached.Provider,
+		CreatedAt:   cached.CreatedAt,
+	}, true
+}
+
+func (s sqliteStore) put(key string, entry Entry) {
+	cached := &models.CachedResponse{
+		Key:         key,
+		Body:        entry.Body,
+		Usage:       entry.Usage,
+		UsageSource: entry.UsageSource,
+		Provider:    entry.Provider,
+		CreatedAt:   entry.CreatedAt,
+		ExpiresAt:   entry.CreatedAt.Add(settings.TTL),
+	}
+	if err := db.StoreCachedResponse(cached, s.maxEntries); err != nil {
+		log.Printf("Error storing cached response: %v", err)
+	}
+}
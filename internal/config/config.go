@@ -1,26 +1,248 @@
 package config
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"log"
+	"os"
 	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/cache"
+	"github.com/vitali/ai-gateway/internal/ratelimit"
+	"github.com/vitali/ai-gateway/internal/token_counter"
 )
 
 type Config struct {
-	Port      int
-	TargetURL string
-	DBPath    string
+	Port             int
+	TargetURL        string
+	DBPath           string
+	StreamUsage      bool   // Request usage in streams via stream_options.include_usage
+	UpstreamType     string // API style of the target, "openai" or "anthropic"
+	AnthropicVersion string // anthropic-version header sent to Anthropic upstreams
+
+	Providers       []Provider // Upstream providers, from the config file or the flags above
+	Routes          []Route    // Model routing rules, checked in order
+	DefaultProvider string     // Provider for models that match no route
+
+	VirtualKeys bool   // Require gateway-issued keys instead of forwarding client keys upstream
+	AdminToken  string // Bearer token for the /admin API, which is disabled when empty
+
+	RateLimits []ratelimit.Rule // Requests and tokens per minute by key, client IP or model
+
+	Cache cache.Settings // Response cache for deterministic requests
+
+	Tokenizers []token_counter.Tokenizer // Encodings for models the built-in tokenizers do not cover
+
+	PricingRefresh time.Duration // How often model pricing is fetched again after startup, 0 to never
 }
 
-func ParseFlags() Config {
+// fileConfig is the format of the JSON file passed with -config
+type fileConfig struct {
+	Providers       []Provider `json:"providers"`
+	Routes          []Route    `json:"routes"`
+	DefaultProvider string     `json:"default_provider"`
+
+	RateLimits []ratelimit.Rule `json:"rate_limits"`
+
+	Tokenizers []token_counter.Tokenizer `json:"tokenizers"`
+}
+
+func ParseFlags() (Config, error) {
 	port := flag.Int("port", 8080, "Port to listen on")
 	targetURL := flag.String("url", "https://router.requesty.ai/v1", "URL of the target API")
 	dbPath := flag.String("db", "ai-gateway.db", "Path to SQLite database file")
+	streamUsage := flag.Bool("stream-usage", true, "Request usage in streaming responses via stream_options (disable for upstreams that reject it)")
+	upstreamType := flag.String("upstream-type", "openai", "API style of the target API: openai or anthropic")
+	anthropicVersion := flag.String("anthropic-version", "2023-06-01", "anthropic-version header sent to Anthropic upstreams")
+	modelPrefix := flag.String("model-prefix", "openai/", "Prefix added to model names without a \"/\" when using -url")
+	apiKey := flag.String("api-key", "", "Upstream API key for the -url target, sent instead of the client's key")
+	virtualKeys := flag.Bool("virtual-keys", false, "Require gateway-issued virtual keys; upstream keys then come only from the provider config")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the /admin API (defaults to $ADMIN_TOKEN)")
+	rpm := flag.Int("rpm", 0, "Requests per minute allowed for each -rate-limit-by value, 0 for no limit")
+	tpm := flag.Int("tpm", 0, "Tokens per minute allowed for each -rate-limit-by value, 0 for no limit")
+	rateLimitBy := flag.String("rate-limit-by", "ip", "What -rpm and -tpm are counted per: key, ip or model")
+	cacheStore := flag.String("cache", "", "Cache responses to deterministic requests in memory or sqlite (disabled when empty)")
+	cacheTTL := flag.Duration("cache-ttl", time.Hour, "How long cached responses are served")
+	cacheMaxEntries := flag.Int("cache-max-entries", 1000, "Maximum number of cached responses")
+	cacheMaxEntryBytes := flag.Int("cache-max-entry-bytes", 1<<20, "Responses larger than this are not cached")
+	pricingRefresh := flag.Duration("pricing-refresh", 24*time.Hour, "How often model pricing is fetched again after startup, 0 to fetch it only at startup")
+	configPath := flag.String("config", "", "Path to a JSON file with providers and routing rules (overrides -url, -upstream-type and -model-prefix)")
 
 	flag.Parse()
 
-	return Config{
-		Port:      *port,
-		TargetURL: strings.TrimSuffix(*targetURL, "/"),
-		DBPath:    *dbPath,
+	cfg := Config{
+		Port:             *port,
+		TargetURL:        strings.TrimSuffix(*targetURL, "/"),
+		DBPath:           *dbPath,
+		StreamUsage:      *streamUsage,
+		UpstreamType:     *upstreamType,
+		AnthropicVersion: *anthropicVersion,
+		VirtualKeys:      *virtualKeys,
+		AdminToken:       *adminToken,
+		PricingRefresh:   *pricingRefresh,
+		Cache: cache.Settings{
+			Store:         *cacheStore,
+			TTL:           *cacheTTL,
+			MaxEntries:    *cacheMaxEntries,
+			MaxEntryBytes: *cacheMaxEntryBytes,
+		},
+	}
+
+	if *configPath == "" {
+		// Without a config file every model goes to the single target API
+		provider := Provider{
+			Name:     "default",
+			BaseURL:  cfg.TargetURL,
+			APIStyle: cfg.UpstreamType,
+			APIKey:   *apiKey,
+		}
+		if provider.APIStyle == "openai" {
+			provider.ModelPrefix = *modelPrefix
+		}
+		cfg.Providers = []Provider{provider}
+		cfg.DefaultProvider = provider.Name
+	} else if err := loadFile(&cfg, *configPath); err != nil {
+		return Config{}, fmt.Errorf("error loading config file %s: %v", *configPath, err)
+	}
+
+	if *rpm > 0 || *tpm > 0 {
+		cfg.RateLimits = append(cfg.RateLimits, ratelimit.Rule{By: *rateLimitBy, RPM: *rpm, TPM: *tpm})
+	}
+
+	if err := validate(cfg); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile reads providers and routes from a JSON config file. API keys may
+// reference environment variables, e.g. "$OPENAI_API_KEY".
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file fileConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	for i := range file.Providers {
+		provider := &file.Providers[i]
+		provider.BaseURL = strings.TrimSuffix(provider.BaseURL, "/")
+		provider.APIKey = os.ExpandEnv(provider.APIKey)
+		if provider.APIStyle == "" {
+			provider.APIStyle = "openai"
+		}
 	}
-}
\ No newline at end of file
+
+	cfg.Providers = file.Providers
+	cfg.Routes = file.Routes
+	cfg.DefaultProvider = file.DefaultProvider
+	cfg.RateLimits = file.RateLimits
+	cfg.Tokenizers = file.Tokenizers
+	if cfg.DefaultProvider == "" && len(cfg.Providers) > 0 {
+		cfg.DefaultProvider = cfg.Providers[0].Name
+	}
+	if len(cfg.Providers) > 0 {
+		// Model pricing is fetched from the default provider
+		if provider, ok := cfg.Provider(cfg.DefaultProvider); ok {
+			cfg.TargetURL = provider.BaseURL
+		}
+	}
+	return nil
+}
+
+// validate checks that providers are complete and routes reference them
+func validate(cfg Config) error {
+	if len(cfg.Providers) == 0 {
+		return fmt.Errorf("no providers configured")
+	}
+
+	names := make(map[string]bool)
+	for _, provider := range cfg.Providers {
+		if provider.Name == "" {
+			return fmt.Errorf("provider without a name")
+		}
+		if names[provider.Name] {
+			return fmt.Errorf("duplicate provider %q", provider.Name)
+		}
+		names[provider.Name] = true
+
+		if provider.BaseURL == "" {
+			return fmt.Errorf("provider %q has no base_url", provider.Name)
+		}
+		if provider.APIStyle != "openai" && provider.APIStyle != "anthropic" {
+			return fmt.Errorf("provider %q has unknown api_style %q", provider.Name, provider.APIStyle)
+		}
+		if provider.TimeoutSeconds < 0 {
+			return fmt.Errorf("provider %q has a negative timeout_seconds", provider.Name)
+		}
+		if provider.Retry != nil && provider.Retry.MaxRetries < 0 {
+			return fmt.Errorf("provider %q has a negative retry.max_retries", provider.Name)
+		}
+		if provider.Breaker != nil && provider.Breaker.ErrorRate > 1 {
+			return fmt.Errorf("provider %q has a breaker.error_rate above 1", provider.Name)
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Match == "" {
+			return fmt.Errorf("route without a match pattern")
+		}
+		if !names[route.Provider] {
+			return fmt.Errorf("route %q references unknown provider %q", route.Match, route.Provider)
+		}
+		for _, fallback := range route.Fallbacks {
+			if !names[fallback.Provider] {
+				return fmt.Errorf("route %q has a fallback to unknown provider %q", route.Match, fallback.Provider)
+			}
+		}
+	}
+
+	for _, rule := range cfg.RateLimits {
+		if rule.By != "key" && rule.By != "ip" && rule.By != "model" {
+			return fmt.Errorf("rate limit by %q must be key, ip or model", rule.By)
+		}
+		if rule.RPM < 0 || rule.TPM < 0 {
+			return fmt.Errorf("rate limit by %s has a negative rpm or tpm", rule.By)
+		}
+		if rule.By == "key" && !cfg.VirtualKeys {
+			log.Printf("Warning: rate limits by key only apply with -virtual-keys")
+		}
+	}
+
+	if cfg.Cache.Store != "" && cfg.Cache.Store != "memory" && cfg.Cache.Store != "sqlite" {
+		return fmt.Errorf("unknown -cache %q, use memory or sqlite", cfg.Cache.Store)
+	}
+	if cfg.Cache.Store != "" && cfg.Cache.TTL <= 0 {
+		return fmt.Errorf("-cache-ttl must be positive")
+	}
+
+	for _, tokenizer := range cfg.Tokenizers {
+		if err := token_counter.ValidateTokenizer(tokenizer); err != nil {
+			return err
+		}
+	}
+
+	if cfg.PricingRefresh < 0 {
+		return fmt.Errorf("-pricing-refresh must not be negative")
+	}
+
+	if cfg.VirtualKeys {
+		for _, provider := range cfg.Providers {
+			if provider.APIKey == "" {
+				log.Printf("Warning: provider %q has no api_key, requests to it are sent without credentials", provider.Name)
+			}
+		}
+	}
+
+	if !names[cfg.DefaultProvider] {
+		return fmt.Errorf("unknown default provider %q", cfg.DefaultProvider)
+	}
+	return nil
+}
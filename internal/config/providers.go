@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/breaker"
+	"github.com/vitali/ai-gateway/internal/retry"
+)
+
+// Provider is an upstream API the gateway can forward requests to
+type Provider struct {
+	Name        string `json:"name"`
+	BaseURL     string `json:"base_url"`               // e.g. https://api.openai.com/v1
+	APIStyle    string `json:"api_style"`              // "openai" or "anthropic"
+	APIKey      string `json:"api_key,omitempty"`      // Sent upstream instead of the client's key when set
+	ModelPrefix string `json:"model_prefix,omitempty"` // Prepended to model names without a "/"
+
+	// TimeoutSeconds limits the wait for response headers, after which the
+	// request fails over to the next target. 0 waits indefinitely.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// Retry overrides retry.DefaultPolicy for this provider
+	Retry *retry.Policy `json:"retry,omitempty"`
+
+	// Breaker overrides breaker.DefaultSettings for this provider
+	Breaker *breaker.Settings `json:"breaker,omitempty"`
+}
+
+// Route sends models matching a pattern to a provider. The pattern is an
+// exact model name, a prefix ending in "*" such as "claude-*", or a glob
+// as understood by path.Match.
+type Route struct {
+	Match     string     `json:"match"`
+	Provider  string     `json:"provider"`
+	Model     string     `json:"model,omitempty"`     // Model name sent upstream instead of the requested one
+	Fallbacks []Fallback `json:"fallbacks,omitempty"` // Tried in order when the provider fails
+}
+
+// Fallback is a target tried after the route's provider returns 429 or 5xx
+// or times out
+type Fallback struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"` // Defaults to the requested model
+}
+
+// Target is a provider together with the model name to request from it
+type Target struct {
+	Provider Provider
+	Model    string
+}
+
+// Matches reports whether the route applies to a model
+func (r Route) Matches(model string) bool {
+	if !strings.ContainsAny(r.Match, "*?[\\") {
+		return r.Match == model
+	}
+
+	// A single trailing "*" is a plain prefix, which unlike a glob also
+	// matches across "/" in names such as "openai/gpt-4o"
+	if prefix, ok := strings.CutSuffix(r.Match, "*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(model, prefix)
+	}
+
+	matched, err := path.Match(r.Match, model)
+	return err == nil && matched
+}
+
+// RetryPolicy returns the provider's retry policy
+func (p Provider) RetryPolicy() retry.Policy {
+	if p.Retry == nil {
+		return retry.DefaultPolicy
+	}
+	return p.Retry.WithDefaults()
+}
+
+// BreakerSettings returns the provider's circuit breaker settings
+func (p Provider) BreakerSettings() breaker.Settings {
+	if p.Breaker == nil {
+		return breaker.DefaultSettings
+	}
+	return p.Breaker.WithDefaults()
+}
+
+// Provider looks up a provider by name
+func (c Config) Provider(name string) (Provider, bool) {
+	for _, provider := range c.Providers {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return Provider{}, false
+}
+
+// Resolve returns the targets for a model: the provider of the first
+// matching route, or the default provider when no route matches, followed by
+// the route's fallbacks
+func (c Config) Resolve(model string) ([]Target, error) {
+	route := Route{Provider: c.DefaultProvider}
+	for _, candidate := range c.Routes {
+		if candidate.Matches(model) {
+			route = candidate
+			break
+		}
+	}
+
+	targets := make([]Target, 0, 1+len(route.Fallbacks))
+	target, err := c.target(route.Provider, route.Model, model)
+	if err != nil {
+		return nil, err
+	}
+	targets = append(targets, target)
+
+	for _, fallback := range route.Fallbacks {
+		target, err := c.target(fallback.Provider, fallback.Model, model)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// target builds the target for a provider, sending upstreamModel if set or
+// else the requested model
+func (c Config) target(providerName, upstreamModel, model string) (Target, error) {
+	provider, ok := c.Provider(providerName)
+	if !ok {
+		return Target{}, fmt.Errorf("no provider configured for model %q", model)
+	}
+
+	if upstreamModel == "" {
+		upstreamModel = model
+	}
+	if provider.ModelPrefix != "" && !strings.Contains(upstreamModel, "/") {
+		upstreamModel = provider.ModelPrefix + upstreamModel
+	}
+
+	return Target{Provider: provider, Model: upstreamModel}, nil
+}
@@ -2,55 +2,69 @@ package converter
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
 
 	"github.com/vitali/ai-gateway/internal/models"
 )
 
-func ConvertToOpenAI(anthropicReq models.AnthropicRequest) models.OpenAIRequest {
-	openaiMessages := make([]models.OpenAIMessage, len(anthropicReq.Messages))
-	for i, msg := range anthropicReq.Messages {
+// UnsupportedContentError is returned when a request contains content that
+// cannot be represented in the OpenAI format
+type UnsupportedContentError struct {
+	Message string
+}
+
+func (e *UnsupportedContentError) Error() string {
+	return e.Message
+}
+
+func unsupportedContent(format string, args ...interface{}) error {
+	return &UnsupportedContentError{Message: fmt.Sprintf(format, args...)}
+}
+
+func ConvertToOpenAI(anthropicReq models.AnthropicRequest) (models.OpenAIRequest, error) {
+	var openaiMessages []models.OpenAIMessage
+
+	systemPrompt, err := SystemPrompt(anthropicReq.System)
+	if err != nil {
+		log.Printf("Error parsing system prompt: %v", err)
+	} else if systemPrompt != "" {
+		openaiMessages = append(openaiMessages, models.OpenAIMessage{
+			Role:    "system",
+			Content: models.OpenAIContent{Text: systemPrompt},
+		})
+	}
+
+	for _, msg := range anthropicReq.Messages {
 		var content string
 
 		err := json.Unmarshal(msg.Content, &content)
 		if err == nil {
-			openaiMessages[i] = models.OpenAIMessage{
+			openaiMessages = append(openaiMessages, models.OpenAIMessage{
 				Role:    msg.Role,
-				Content: content,
-			}
+				Content: models.OpenAIContent{Text: content},
+			})
 		} else {
-			var structuredContent []map[string]interface{}
+			var structuredContent []models.AnthropicContent
 			err = json.Unmarshal(msg.Content, &structuredContent)
 			if err == nil {
-				combinedContent := ""
-				for _, block := range structuredContent {
-					if blockType, ok := block["type"].(string); ok && blockType == "text" {
-						if text, ok := block["text"].(string); ok {
-							combinedContent += text
-						}
-					}
-				}
-				openaiMessages[i] = models.OpenAIMessage{
-					Role:    msg.Role,
-					Content: combinedContent,
+				messages, err := convertContentBlocks(msg.Role, structuredContent)
+				if err != nil {
+					return models.OpenAIRequest{}, err
 				}
+				openaiMessages = append(openaiMessages, messages...)
 			} else {
 				log.Printf("Error parsing message content: %v", err)
-				openaiMessages[i] = models.OpenAIMessage{
+				openaiMessages = append(openaiMessages, models.OpenAIMessage{
 					Role:    msg.Role,
-					Content: "",
-				}
+					Content: models.OpenAIContent{},
+				})
 			}
 		}
 	}
-	model := anthropicReq.Model
-	if !strings.Contains(model, "/") {
-		model = "openai/" + model
-	}
-
 	openaiReq := models.OpenAIRequest{
-		Model:     model,
+		Model:     anthropicReq.Model,
 		MaxTokens: anthropicReq.MaxTokensToSample,
 		Messages:  openaiMessages,
 		Stream:    anthropicReq.Stream,
@@ -72,6 +86,27 @@ func ConvertToOpenAI(anthropicReq models.AnthropicRequest) models.OpenAIRequest
 		openaiReq.FrequencyPenalty = anthropicReq.FrequencyPenalty
 	}
 
+	if len(anthropicReq.Tools) > 0 {
+		openaiReq.Tools = make([]models.OpenAITool, len(anthropicReq.Tools))
+		for i, tool := range anthropicReq.Tools {
+			openaiReq.Tools[i] = models.OpenAITool{
+				Type: "function",
+				Function: models.OpenAIFunction{
+					Name:        tool.Name,
+					Description: tool.Description,
+					Parameters:  tool.InputSchema,
+				},
+			}
+		}
+	}
+	if anthropicReq.ToolChoice != nil {
+		openaiReq.ToolChoice = convertToolChoice(*anthropicReq.ToolChoice)
+		if disable := anthropicReq.ToolChoice.DisableParallelToolUse; disable != nil && *disable && len(openaiReq.Tools) > 0 {
+			parallel := false
+			openaiReq.ParallelToolCalls = &parallel
+		}
+	}
+
 	// Map TopK to N if present (approximate mapping)
 	if anthropicReq.TopK != nil {
 		n := *anthropicReq.TopK
@@ -80,10 +115,13 @@ func ConvertToOpenAI(anthropicReq models.AnthropicRequest) models.OpenAIRequest
 		}
 	}
 
-	return openaiReq
+	return openaiReq, nil
 }
 
-func ConvertToAnthropic(openaiResp models.OpenAIResponse) models.AnthropicResponse {
+// ConvertToAnthropic converts an OpenAI response into the Anthropic format.
+// stopSequences are the stop sequences of the request, used to report which
+// one ended the completion.
+func ConvertToAnthropic(openaiResp models.OpenAIResponse, stopSequences []string) models.AnthropicResponse {
 	anthropicResp := models.AnthropicResponse{
 		Id:    openaiResp.Id,
 		Type:  "message",
@@ -97,17 +135,308 @@ func ConvertToAnthropic(openaiResp models.OpenAIResponse) models.AnthropicRespon
 
 	if len(openaiResp.Choices) > 0 {
 		choice := openaiResp.Choices[0]
-		anthropicResp.Content = []models.AnthropicContent{
-			{
+		text := choice.Message.Content.PlainText()
+		if text != "" || len(choice.Message.ToolCalls) == 0 {
+			anthropicResp.Content = append(anthropicResp.Content, models.AnthropicContent{
 				Type: "text",
-				Text: choice.Message.Content,
-			},
+				Text: text,
+			})
 		}
-
-		if choice.FinishReason != "" {
-			anthropicResp.StopReason = choice.FinishReason
+		for _, toolCall := range choice.Message.ToolCalls {
+			anthropicResp.Content = append(anthropicResp.Content, models.AnthropicContent{
+				Type:  "tool_use",
+				Id:    toolCall.Id,
+				Name:  toolCall.Function.Name,
+				Input: ToolInput(toolCall.Function.Arguments),
+			})
 		}
+
+		matched := MatchedStopSequence(choice.StopReason, choice.MatchedStop)
+		anthropicResp.StopReason, anthropicResp.StopSequence = ConvertStopReason(choice.FinishReason, len(choice.Message.ToolCalls) > 0, text, matched, stopSequences)
 	}
 
 	return anthropicResp
 }
+
+// ConvertStopReason maps an OpenAI finish_reason onto an Anthropic
+// stop_reason. OpenAI reports both end of turn and a matched stop sequence
+// as "stop", so the stop sequence is taken from the upstream's matched value
+// when it reports one, or detected at the end of the output for upstreams
+// that do not strip it. The second return value is the matched stop sequence.
+func ConvertStopReason(finishReason string, hasToolCalls bool, output string, matched string, stopSequences []string) (string, string) {
+	if hasToolCalls {
+		return "tool_use", ""
+	}
+
+	switch finishReason {
+	case "length":
+		return "max_tokens", ""
+	case "tool_calls", "function_call":
+		return "tool_use", ""
+	case "content_filter":
+		return "refusal", ""
+	case "stop":
+		for _, sequence := range stopSequences {
+			if sequence != "" && sequence == matched {
+				return "stop_sequence", sequence
+			}
+		}
+		for _, sequence := range stopSequences {
+			if sequence != "" && strings.HasSuffix(output, sequence) {
+				return "stop_sequence", sequence
+			}
+		}
+		return "end_turn", ""
+	case "":
+		return "end_turn", ""
+	}
+
+	log.Printf("Unknown finish reason %q, reporting end_turn", finishReason)
+	return "end_turn", ""
+}
+
+// MatchedStopSequence returns the first of the upstream's matched stop values
+// that is a string. Token ids and nulls are ignored.
+func MatchedStopSequence(values ...json.RawMessage) string {
+	for _, value := range values {
+		var matched string
+		if len(value) > 0 && json.Unmarshal(value, &matched) == nil && matched != "" {
+			return matched
+		}
+	}
+	return ""
+}
+
+// SystemPrompt flattens the Anthropic system field, which is either a string
+// or an array of text blocks, into a single string
+func SystemPrompt(system json.RawMessage) (string, error) {
+	if len(system) == 0 || string(system) == "null" {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(system, &text); err == nil {
+		return text, nil
+	}
+
+	var blocks []models.AnthropicContent
+	if err := json.Unmarshal(system, &blocks); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// OpenAISystemPrompt joins the content of the system messages of an OpenAI
+// request. Newer models also accept "developer" for the same purpose.
+func OpenAISystemPrompt(messages []models.OpenAIMessage) string {
+	var parts []string
+	for _, message := range messages {
+		if message.Role == "system" || message.Role == "developer" {
+			parts = append(parts, message.Content.PlainText())
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ToolInput turns OpenAI function call arguments into an Anthropic tool_use
+// input object, falling back to an empty object for missing or invalid JSON
+func ToolInput(arguments string) json.RawMessage {
+	if strings.TrimSpace(arguments) == "" {
+		return json.RawMessage("{}")
+	}
+	if !json.Valid([]byte(arguments)) {
+		log.Printf("Invalid tool call arguments, using empty input: %s", arguments)
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// convertContentBlocks converts the content blocks of a single Anthropic
+// message into one or more OpenAI messages. Assistant tool_use blocks become
+// tool_calls, and user tool_result blocks become separate "tool" messages that
+// precede any remaining user content, as OpenAI requires tool messages to
+// follow the assistant message that issued the calls. Image and document
+// blocks turn the content into an array of parts.
+func convertContentBlocks(role string, blocks []models.AnthropicContent) ([]models.OpenAIMessage, error) {
+	var toolMessages []models.OpenAIMessage
+	var toolCalls []models.OpenAIToolCall
+	var parts []models.OpenAIContentPart
+	multimodal := false
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, models.OpenAIContentPart{
+				Type: "text",
+				Text: block.Text,
+			})
+		case "image", "document":
+			if role != "user" {
+				return nil, unsupportedContent("%s content blocks are only supported in user messages", block.Type)
+			}
+			part, err := convertSourceBlock(block)
+			if err != nil {
+				return nil, err
+			}
+			if part.Type != "text" {
+				multimodal = true
+			}
+			parts = append(parts, part)
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 {
+				arguments = string(block.Input)
+			}
+			toolCalls = append(toolCalls, models.OpenAIToolCall{
+				Id:   block.Id,
+				Type: "function",
+				Function: models.OpenAIFunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		case "tool_result":
+			content, err := toolResultText(block.Content)
+			if err != nil {
+				return nil, err
+			}
+			if block.IsError {
+				content = "Error: " + content
+			}
+			toolMessages = append(toolMessages, models.OpenAIMessage{
+				Role:       "tool",
+				Content:    models.OpenAIContent{Text: content},
+				ToolCallId: block.ToolUseId,
+			})
+		case "thinking", "redacted_thinking":
+			// Reasoning from previous turns has no OpenAI equivalent and is
+			// safe to drop
+		default:
+			return nil, unsupportedContent("content block type %q is not supported by the upstream API", block.Type)
+		}
+	}
+
+	var content models.OpenAIContent
+	if multimodal {
+		content.Parts = parts
+	} else {
+		for _, part := range parts {
+			content.Text += part.Text
+		}
+	}
+
+	messages := toolMessages
+	if len(parts) > 0 || len(toolCalls) > 0 || len(toolMessages) == 0 {
+		messages = append(messages, models.OpenAIMessage{
+			Role:      role,
+			Content:   content,
+			ToolCalls: toolCalls,
+		})
+	}
+	return messages, nil
+}
+
+// convertSourceBlock converts an image or document block into an OpenAI
+// content part. Base64 sources are sent inline as data URLs.
+func convertSourceBlock(block models.AnthropicContent) (models.OpenAIContentPart, error) {
+	source := block.Source
+	if source == nil {
+		return models.OpenAIContentPart{}, unsupportedContent("%s content block is missing a source", block.Type)
+	}
+
+	if block.Type == "image" {
+		switch source.Type {
+		case "base64":
+			return models.OpenAIContentPart{
+				Type: "image_url",
+				ImageURL: &models.OpenAIImageURL{
+					URL: "data:" + source.MediaType + ";base64," + source.Data,
+				},
+			}, nil
+		case "url":
+			return models.OpenAIContentPart{
+				Type: "image_url",
+				ImageURL: &models.OpenAIImageURL{
+					URL: source.URL,
+				},
+			}, nil
+		}
+		return models.OpenAIContentPart{}, unsupportedContent("image source type %q is not supported by the upstream API", source.Type)
+	}
+
+	switch source.Type {
+	case "base64":
+		if source.MediaType != "application/pdf" {
+			return models.OpenAIContentPart{}, unsupportedContent("document media type %q is not supported by the upstream API", source.MediaType)
+		}
+		filename := block.Title
+		if filename == "" {
+			filename = "document.pdf"
+		}
+		return models.OpenAIContentPart{
+			Type: "file",
+			File: &models.OpenAIFile{
+				Filename: filename,
+				FileData: "data:" + source.MediaType + ";base64," + source.Data,
+			},
+		}, nil
+	case "text":
+		return models.OpenAIContentPart{
+			Type: "text",
+			Text: source.Data,
+		}, nil
+	}
+	return models.OpenAIContentPart{}, unsupportedContent("document source type %q is not supported by the upstream API", source.Type)
+}
+
+// toolResultText flattens tool_result content, which is either a string or an
+// array of text blocks, into plain text. OpenAI tool messages are text only.
+func toolResultText(content json.RawMessage) (string, error) {
+	if len(content) == 0 {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text, nil
+	}
+
+	var blocks []models.AnthropicContent
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		log.Printf("Error parsing tool result content: %v", err)
+		return "", nil
+	}
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return "", unsupportedContent("%s blocks in tool results are not supported by the upstream API", block.Type)
+		}
+		text += block.Text
+	}
+	return text, nil
+}
+
+// convertToolChoice maps an Anthropic tool_choice onto the OpenAI equivalent
+func convertToolChoice(choice models.AnthropicToolChoice) interface{} {
+	switch choice.Type {
+	case "any":
+		return "required"
+	case "none":
+		return "none"
+	case "tool":
+		return map[string]interface{}{
+			"type": "function",
+			"function": map[string]string{
+				"name": choice.Name,
+			},
+		}
+	default:
+		return "auto"
+	}
+}
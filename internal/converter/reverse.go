@@ -0,0 +1,327 @@
+package converter
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// DefaultMaxTokens is used when an OpenAI request does not set max_tokens,
+// as the Anthropic Messages API requires it
+const DefaultMaxTokens = 4096
+
+// ConvertToAnthropicRequest converts an OpenAI chat completion request into an
+// Anthropic Messages request, for serving OpenAI clients from an Anthropic
+// upstream. System messages are moved to the top-level system field and tool
+// messages become tool_result blocks in a user turn.
+func ConvertToAnthropicRequest(openaiReq models.OpenAIRequest) (models.AnthropicRequest, error) {
+	anthropicReq := models.AnthropicRequest{
+		Model:             openaiReq.Model,
+		MaxTokensToSample: openaiReq.MaxTokens,
+		Stream:            openaiReq.Stream,
+		TopP:              openaiReq.TopP,
+		StopSequences:     openaiReq.Stop,
+	}
+	if openaiReq.MaxCompletionTokens > 0 {
+		anthropicReq.MaxTokensToSample = openaiReq.MaxCompletionTokens
+	}
+	if anthropicReq.MaxTokensToSample <= 0 {
+		anthropicReq.MaxTokensToSample = DefaultMaxTokens
+	}
+
+	// OpenAI accepts temperatures up to 2, Anthropic only up to 1
+	if openaiReq.Temperature != nil {
+		temperature := *openaiReq.Temperature
+		if temperature > 1 {
+			temperature = 1
+		}
+		anthropicReq.Temperature = &temperature
+	}
+
+	if systemPrompt := OpenAISystemPrompt(openaiReq.Messages); systemPrompt != "" {
+		system, err := json.Marshal(systemPrompt)
+		if err != nil {
+			return models.AnthropicRequest{}, err
+		}
+		anthropicReq.System = system
+	}
+
+	var toolResults []models.AnthropicContent
+	flushToolResults := func() error {
+		if len(toolResults) == 0 {
+			return nil
+		}
+		message, err := anthropicMessage("user", toolResults)
+		if err != nil {
+			return err
+		}
+		anthropicReq.Messages = append(anthropicReq.Messages, message)
+		toolResults = nil
+		return nil
+	}
+
+	for _, msg := range openaiReq.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			continue
+		case "tool":
+			content, err := json.Marshal(msg.Content.PlainText())
+			if err != nil {
+				return models.AnthropicRequest{}, err
+			}
+			toolResults = append(toolResults, models.AnthropicContent{
+				Type:      "tool_result",
+				ToolUseId: msg.ToolCallId,
+				Content:   content,
+			})
+			continue
+		}
+
+		// Consecutive tool messages answer the same assistant turn and are
+		// sent together as one user message
+		if err := flushToolResults(); err != nil {
+			return models.AnthropicRequest{}, err
+		}
+
+		blocks, err := convertOpenAIContent(msg.Content)
+		if err != nil {
+			return models.AnthropicRequest{}, err
+		}
+		for _, toolCall := range msg.ToolCalls {
+			blocks = append(blocks, models.AnthropicContent{
+				Type:  "tool_use",
+				Id:    toolCall.Id,
+				Name:  toolCall.Function.Name,
+				Input: ToolInput(toolCall.Function.Arguments),
+			})
+		}
+
+		message, err := anthropicMessage(msg.Role, blocks)
+		if err != nil {
+			return models.AnthropicRequest{}, err
+		}
+		anthropicReq.Messages = append(anthropicReq.Messages, message)
+	}
+	if err := flushToolResults(); err != nil {
+		return models.AnthropicRequest{}, err
+	}
+
+	for _, tool := range openaiReq.Tools {
+		inputSchema := tool.Function.Parameters
+		if len(inputSchema) == 0 {
+			inputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		anthropicReq.Tools = append(anthropicReq.Tools, models.AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+
+	if openaiReq.ToolChoice != nil || openaiReq.ParallelToolCalls != nil {
+		toolChoice := convertOpenAIToolChoice(openaiReq.ToolChoice)
+		if openaiReq.ParallelToolCalls != nil && !*openaiReq.ParallelToolCalls && toolChoice.Type != "none" {
+			disable := true
+			toolChoice.DisableParallelToolUse = &disable
+		}
+		if len(anthropicReq.Tools) > 0 {
+			anthropicReq.ToolChoice = &toolChoice
+		}
+	}
+
+	return anthropicReq, nil
+}
+
+// anthropicMessage builds a message whose content is an array of blocks. A
+// single text block is sent as a plain string.
+func anthropicMessage(role string, blocks []models.AnthropicContent) (models.AnthropicMessage, error) {
+	var content interface{} = blocks
+	if len(blocks) == 1 && blocks[0].Type == "text" {
+		content = blocks[0].Text
+	} else if len(blocks) == 0 {
+		content = ""
+	}
+
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return models.AnthropicMessage{}, err
+	}
+	return models.AnthropicMessage{
+		Role:    role,
+		Content: contentJSON,
+	}, nil
+}
+
+// convertOpenAIContent converts OpenAI message content into Anthropic blocks
+func convertOpenAIContent(content models.OpenAIContent) ([]models.AnthropicContent, error) {
+	if content.Parts == nil {
+		if content.Text == "" {
+			return nil, nil
+		}
+		return []models.AnthropicContent{{Type: "text", Text: content.Text}}, nil
+	}
+
+	var blocks []models.AnthropicContent
+	for _, part := range content.Parts {
+		switch part.Type {
+		case "text":
+			blocks = append(blocks, models.AnthropicContent{Type: "text", Text: part.Text})
+		case "image_url":
+			if part.ImageURL == nil {
+				return nil, unsupportedContent("image_url content part is missing the image_url field")
+			}
+			blocks = append(blocks, models.AnthropicContent{
+				Type:   "image",
+				Source: imageSource(part.ImageURL.URL),
+			})
+		case "file":
+			if part.File == nil || part.File.FileData == "" {
+				return nil, unsupportedContent("only inline file content parts are supported by the upstream API")
+			}
+			mediaType, data, ok := parseDataURL(part.File.FileData)
+			if !ok {
+				return nil, unsupportedContent("file content part must be a base64 data URL")
+			}
+			blocks = append(blocks, models.AnthropicContent{
+				Type:  "document",
+				Title: part.File.Filename,
+				Source: &models.AnthropicSource{
+					Type:      "base64",
+					MediaType: mediaType,
+					Data:      data,
+				},
+			})
+		default:
+			return nil, unsupportedContent("content part type %q is not supported by the upstream API", part.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// imageSource turns an OpenAI image URL, which may be a data URL, into an
+// Anthropic image source
+func imageSource(url string) *models.AnthropicSource {
+	if mediaType, data, ok := parseDataURL(url); ok {
+		return &models.AnthropicSource{
+			Type:      "base64",
+			MediaType: mediaType,
+			Data:      data,
+		}
+	}
+	return &models.AnthropicSource{
+		Type: "url",
+		URL:  url,
+	}
+}
+
+// parseDataURL splits a base64 data URL such as "data:image/png;base64,..."
+// into its media type and data
+func parseDataURL(url string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", "", false
+	}
+	header, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", false
+	}
+	mediaType, ok := strings.CutSuffix(header, ";base64")
+	if !ok {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
+
+// convertOpenAIToolChoice maps an OpenAI tool_choice, which is a string or an
+// object naming a function, onto the Anthropic equivalent
+func convertOpenAIToolChoice(choice interface{}) models.AnthropicToolChoice {
+	switch value := choice.(type) {
+	case string:
+		switch value {
+		case "required":
+			return models.AnthropicToolChoice{Type: "any"}
+		case "none":
+			return models.AnthropicToolChoice{Type: "none"}
+		}
+	case map[string]interface{}:
+		if function, ok := value["function"].(map[string]interface{}); ok {
+			if name, ok := function["name"].(string); ok {
+				return models.AnthropicToolChoice{Type: "tool", Name: name}
+			}
+		}
+	}
+	return models.AnthropicToolChoice{Type: "auto"}
+}
+
+// ConvertToOpenAIResponse converts an Anthropic Messages response into an
+// OpenAI chat completion
+func ConvertToOpenAIResponse(anthropicResp models.AnthropicResponse) models.OpenAIResponse {
+	message := models.OpenAIMessage{Role: "assistant"}
+	for _, block := range anthropicResp.Content {
+		switch block.Type {
+		case "text":
+			message.Content.Text += block.Text
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 {
+				arguments = string(block.Input)
+			}
+			message.ToolCalls = append(message.ToolCalls, models.OpenAIToolCall{
+				Id:   block.Id,
+				Type: "function",
+				Function: models.OpenAIFunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+
+	usage := OpenAIUsage(anthropicResp.Usage)
+	return models.OpenAIResponse{
+		Id:      anthropicResp.Id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   anthropicResp.Model,
+		Choices: []models.OpenAIChoice{
+			{
+				Index:        0,
+				Message:      message,
+				FinishReason: ConvertFinishReason(anthropicResp.StopReason),
+			},
+		},
+		Usage: usage,
+	}
+}
+
+// OpenAIUsage converts Anthropic usage. Anthropic reports cached prompt
+// tokens separately, while OpenAI includes them in prompt_tokens.
+func OpenAIUsage(usage models.AnthropicUsage) models.OpenAIUsage {
+	promptTokens := usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
+	return models.OpenAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      promptTokens + usage.OutputTokens,
+	}
+}
+
+// ConvertFinishReason maps an Anthropic stop_reason onto an OpenAI
+// finish_reason
+func ConvertFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence", "pause_turn", "":
+		return "stop"
+	case "max_tokens", "model_context_window_exceeded":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	}
+
+	log.Printf("Unknown stop reason %q, reporting stop", stopReason)
+	return "stop"
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// DefaultBudgetWarnAt is the fraction of a budget after which warnings are
+// sent when a budget doesn't set its own
+const DefaultBudgetWarnAt = 0.8
+
+// PeriodStart returns when the current period of a budget began
+func PeriodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	switch period {
+	case "daily":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	case "monthly":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Time{}
+}
+
+// NextReset returns when a budget resets, or the zero time for lifetime
+// budgets
+func NextReset(period string, now time.Time) time.Time {
+	start := PeriodStart(period, now)
+	switch period {
+	case "daily":
+		return start.AddDate(0, 0, 1)
+	case "monthly":
+		return start.AddDate(0, 1, 0)
+	}
+	return time.Time{}
+}
+
+// CreateBudget validates and stores a budget
+func CreateBudget(budget *models.Budget) error {
+	if (budget.KeyID == 0) == (budget.Project == "") {
+		return fmt.Errorf("a budget needs either a key_id or a project")
+	}
+	if budget.Period != "daily" && budget.Period != "monthly" && budget.Period != "lifetime" {
+		return fmt.Errorf("period must be daily, monthly or lifetime")
+	}
+	if budget.LimitUSD <= 0 {
+		return fmt.Errorf("limit_usd must be positive")
+	}
+	if budget.WarnAt <= 0 || budget.WarnAt > 1 {
+		budget.WarnAt = DefaultBudgetWarnAt
+	}
+
+	result := DB.Create(budget)
+	return result.Error
+}
+
+// ListBudgets returns all budgets
+func ListBudgets() ([]models.Budget, error) {
+	var budgets []models.Budget
+	result := DB.Order("id").Find(&budgets)
+	return budgets, result.Error
+}
+
+// DeleteBudget removes a budget
+func DeleteBudget(id uint) error {
+	result := DB.Delete(&models.Budget{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("budget %d not found", id)
+	}
+	return nil
+}
+
+// BudgetsForKey returns the budgets of a key and of its project
+func BudgetsForKey(virtualKey *models.VirtualKey) ([]models.Budget, error) {
+	var budgets []models.Budget
+	query := DB.Where("key_id = ?", virtualKey.ID)
+	if virtualKey.Project != "" {
+		query = query.Or("project = ?", virtualKey.Project)
+	}
+	result := query.Find(&budgets)
+	return budgets, result.Error
+}
+
+// BudgetSpend sums the logged cost of requests counted against a budget in
+// its current period
+func BudgetSpend(budget models.Budget, now time.Time) (float64, error) {
+	// Timestamps are stored with the offset of the zone they were taken in,
+	// and SQLite compares them as text, so both sides are converted to UTC
+	periodStart := PeriodStart(budget.Period, now)
+	query := DB.Model(&models.RequestLog{}).Where("strftime('%Y-%m-%d %H:%M:%f', timestamp) >= strftime('%Y-%m-%d %H:%M:%f', ?)", periodStart)
+	if budget.KeyID != 0 {
+		query = query.Where("key_id = ?", budget.KeyID)
+	} else {
+		keys := DB.Model(&models.VirtualKey{}).Select("id").Where("project = ?", budget.Project)
+		query = query.Where("key_id IN (?)", keys)
+	}
+
+	var spend float64
+	result := query.Select("COALESCE(SUM(cost), 0)").Scan(&spend)
+	return spend, result.Error
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FindCachedResponse returns a cached response that has not expired, or nil
+func FindCachedResponse(key string, now time.Time) (*models.CachedResponse, error) {
+	var entry models.CachedResponse
+	result := DB.Where("key = ? AND expires_at > ?", key, now).First(&entry)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &entry, nil
+}
+
+// StoreCachedResponse saves a cached response, replacing any older one for
+// the same request, then drops expired entries and the oldest entries beyond
+// maxEntries
+func StoreCachedResponse(entry *models.CachedResponse, maxEntries int) error {
+	if err := DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(entry).Error; err != nil {
+		return err
+	}
+
+	if err := DB.Where("expires_at <= ?", entry.CreatedAt).Delete(&models.CachedResponse{}).Error; err != nil {
+		return err
+	}
+
+	if maxEntries > 0 {
+		newest := DB.Model(&models.CachedResponse{}).Select("key").Order("created_at DESC").Limit(maxEntries)
+		if err := DB.Where("key NOT IN (?)", newest).Delete(&models.CachedResponse{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
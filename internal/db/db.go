@@ -30,7 +30,14 @@ func InitDB(dbPath string) (*gorm.DB, error) {
 	}
 
  // Auto migrate the schema
-	err = db.AutoMigrate(&models.RequestLog{}, &models.ModelPrice{})
+	err = db.AutoMigrate(&models.RequestLog{}, &models.RequestAttempt{}, &models.VirtualKey{}, &models.Budget{}, &models.CachedResponse{}, &models.ModelPrice{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Prices stored before they were versioned apply from when they were
+	// fetched. Price dates are kept in UTC so that they compare as text.
+	err = db.Model(&models.ModelPrice{}).Where("effective_from IS NULL").Update("effective_from", gorm.Expr("strftime('%Y-%m-%d %H:%M:%f+00:00', created_at)")).Error
 	if err != nil {
 		return nil, err
 	}
@@ -93,46 +100,86 @@ func FetchAndStoreModelPricing(targetURL string) error {
 	}
 
 	// Store the model pricing in the database
+	now := time.Now().UTC()
 	for _, model := range modelsResponse.Data {
-		modelPrice := models.ModelPrice{
-			ModelName:   model.ID,
-			InputPrice:  model.InputPrice,
-			OutputPrice: model.OutputPrice,
+		stored, err := storeModelPrice(model.ID, model.InputPrice, model.OutputPrice, now)
+		if err != nil {
+			log.Printf("Error storing model pricing for %s: %v", model.ID, err)
+			continue
+		}
+		if stored {
+			log.Printf("Stored pricing for model %s: input=%f, output=%f", model.ID, model.InputPrice, model.OutputPrice)
 		}
+	}
 
-		// Use Upsert to handle existing models
-		result := DB.Where("model_name = ?", model.ID).FirstOrCreate(&modelPrice)
+	return nil
+}
+
+// storeModelPrice records the price of a model from the given UTC time.
+// When it differs from the current price, the current one is closed and a
+// new version created, so that past requests keep the price they were made
+// at. It reports whether a new version was stored.
+func storeModelPrice(modelName string, inputPrice float64, outputPrice float64, from time.Time) (bool, error) {
+	stored := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var current models.ModelPrice
+		result := tx.Where("model_name = ? AND effective_to IS NULL", modelName).Order("effective_from DESC").Limit(1).Find(&current)
 		if result.Error != nil {
-			log.Printf("Error storing model pricing for %s: %v", model.ID, result.Error)
-			continue
+			return result.Error
 		}
 
-		// If the model exists but prices have changed, update them
-		if result.RowsAffected == 0 {
-			DB.Model(&modelPrice).Updates(models.ModelPrice{
-				InputPrice:  model.InputPrice,
-				OutputPrice: model.OutputPrice,
-			})
+		if result.RowsAffected > 0 {
+			if current.InputPrice == inputPrice && current.OutputPrice == outputPrice {
+				return nil
+			}
+			if err := tx.Model(&current).Update("effective_to", from).Error; err != nil {
+				return err
+			}
 		}
 
-		log.Printf("Stored pricing for model %s: input=%f, output=%f", model.ID, model.InputPrice, model.OutputPrice)
-	}
-
-	return nil
+		stored = true
+		return tx.Create(&models.ModelPrice{
+			ModelName:     modelName,
+			InputPrice:    inputPrice,
+			OutputPrice:   outputPrice,
+			EffectiveFrom: from,
+		}).Error
+	})
+	return stored, err
 }
 
-// GetModelPricing gets the pricing information for a specific model
-func GetModelPricing(modelName string) (*models.ModelPrice, error) {
+// GetModelPricing gets the price of a model that was in effect at the given
+// time. Requests made before the first known price use that price.
+func GetModelPricing(modelName string, at time.Time) (*models.ModelPrice, error) {
+	at = at.UTC()
 	var modelPrice models.ModelPrice
-	result := DB.Where("model_name = ?", modelName).First(&modelPrice)
+	result := DB.Where("model_name = ? AND effective_from <= ? AND (effective_to IS NULL OR effective_to > ?)", modelName, at, at).
+		Order("effective_from DESC").Limit(1).Find(&modelPrice)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return &modelPrice, nil
+	}
+
+	result = DB.Where("model_name = ?", modelName).Order("effective_from").First(&modelPrice)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return &modelPrice, nil
 }
 
-// CalculateCost calculates the cost of a request based on token usage and model pricing
-func CalculateCost(modelName string, usageJSON string) (float64, error) {
+// GetModelPriceHistory returns every price of every model, ordered by model
+// and newest first
+func GetModelPriceHistory() ([]models.ModelPrice, error) {
+	var modelPrices []models.ModelPrice
+	result := DB.Order("model_name").Order("effective_from DESC").Find(&modelPrices)
+	return modelPrices, result.Error
+}
+
+// CalculateCost calculates the cost of a request based on token usage and the
+// model pricing in effect when the request was made
+func CalculateCost(modelName string, usageJSON string, at time.Time) (float64, error) {
 	if usageJSON == "" {
 		return 0, nil
 	}
@@ -144,7 +191,7 @@ func CalculateCost(modelName string, usageJSON string) (float64, error) {
 	}
 
 	// Get the model pricing
-	modelPrice, err := GetModelPricing(modelName)
+	modelPrice, err := GetModelPricing(modelName, at)
 	if err != nil {
 		return 0, fmt.Errorf("error getting model pricing: %v", err)
 	}
@@ -180,7 +227,7 @@ func GenerateRandomID() string {
 }
 
 // LogRequest creates a new request log entry
-func LogRequest(r *http.Request, requestType string, requestBody string, model string, isStreaming bool, additionalParams string) (*models.RequestLog, error) {
+func LogRequest(r *http.Request, requestType string, requestBody string, model string, isStreaming bool, additionalParams string, systemPrompt string) (*models.RequestLog, error) {
 	// Convert headers to JSON
 	headerMap := make(map[string][]string)
 	for k, v := range r.Header {
@@ -198,6 +245,7 @@ func LogRequest(r *http.Request, requestType string, requestBody string, model s
 		RequestHeaders:   string(headerJSON),
 		RequestBody:      requestBody,
 		RequestType:      requestType,
+		SystemPrompt:     systemPrompt,
 		ModelName:        model,
 		IsStreaming:      isStreaming,
 		AdditionalParams: additionalParams,
@@ -211,6 +259,12 @@ func LogRequest(r *http.Request, requestType string, requestBody string, model s
 	return requestLog, nil
 }
 
+// LogAttempt records an upstream call made for a request
+func LogAttempt(attempt *models.RequestAttempt) error {
+	result := DB.Create(attempt)
+	return result.Error
+}
+
 // UpdateResponseLog updates the response information in the request log
 func UpdateResponseLog(requestLog *models.RequestLog, status int, responseHeaders http.Header, responseBody string, processingTime int64, usage ...string) error {
 	// Convert headers to JSON
@@ -232,10 +286,14 @@ func UpdateResponseLog(requestLog *models.RequestLog, status int, responseHeader
 	// Set usage if provided
 	if len(usage) > 0 && usage[0] != "" {
 		requestLog.Usage = usage[0]
+		requestLog.UsageAccuracy = usageAccuracy(requestLog)
 
 		// Calculate cost for requests with usage data (both streaming and non-streaming)
-		cost, err := CalculateCost(requestLog.ModelName, usage[0])
-		if err != nil {
+		cost, err := CalculateCost(answeringModel(requestLog), usage[0], requestLog.Timestamp)
+		if requestLog.CacheHit {
+			// Cached answers cost nothing, the usage is kept for reference
+			requestLog.Cost = 0
+		} else if err != nil {
 			log.Printf("Error calculating cost: %v", err)
 		} else {
 			requestLog.Cost = cost
@@ -246,3 +304,24 @@ func UpdateResponseLog(requestLog *models.RequestLog, status int, responseHeader
 	result := DB.Save(requestLog)
 	return result.Error
 }
+
+// answeringModel returns the model that answered a request, as sent to the
+// upstream. It differs from the requested model after a fallback or when the
+// provider rewrites model names.
+func answeringModel(requestLog *models.RequestLog) string {
+	if requestLog.UpstreamModel != "" {
+		return requestLog.UpstreamModel
+	}
+	return requestLog.ModelName
+}
+
+// usageAccuracy tells whether the usage of a request is exact, which only
+// usage reported by the upstream is. Local estimates are approximate even
+// with the model's own tokenizer, since the upstream's prompt formatting is
+// not known exactly.
+func usageAccuracy(requestLog *models.RequestLog) string {
+	if requestLog.UsageSource == "reported" {
+		return "exact"
+	}
+	return "approximate"
+}
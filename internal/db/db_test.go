@@ -0,0 +1,153 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/models"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB points the global database at a fresh database for the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	testDB, err := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB.Logger = logger.Default.LogMode(logger.Silent)
+
+	previous := DB
+	DB = testDB
+	t.Cleanup(func() { DB = previous })
+}
+
+func storePrice(t *testing.T, inputPrice float64, from time.Time) bool {
+	t.Helper()
+	stored, err := storeModelPrice("m", inputPrice, inputPrice*2, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func priceVersions(t *testing.T) []models.ModelPrice {
+	t.Helper()
+	var prices []models.ModelPrice
+	if err := DB.Where("model_name = ?", "m").Order("effective_from").Find(&prices).Error; err != nil {
+		t.Fatal(err)
+	}
+	return prices
+}
+
+func TestStoreModelPriceUnchanged(t *testing.T) {
+	useTestDB(t)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if !storePrice(t, 1, t0) {
+		t.Fatal("first price not stored")
+	}
+	if storePrice(t, 1, t0.Add(time.Hour)) {
+		t.Error("unchanged price stored as a new version")
+	}
+
+	prices := priceVersions(t)
+	if len(prices) != 1 || prices[0].EffectiveTo != nil {
+		t.Errorf("got %d versions, want a single current one", len(prices))
+	}
+}
+
+func TestStoreModelPriceChanged(t *testing.T) {
+	useTestDB(t)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(24 * time.Hour)
+
+	storePrice(t, 1, t0)
+	if !storePrice(t, 3, t1) {
+		t.Fatal("changed price not stored")
+	}
+
+	prices := priceVersions(t)
+	if len(prices) != 2 {
+		t.Fatalf("got %d versions, want 2", len(prices))
+	}
+	if prices[0].EffectiveTo == nil || !prices[0].EffectiveTo.Equal(t1) {
+		t.Errorf("old version ends at %v, want %v", prices[0].EffectiveTo, t1)
+	}
+	if !prices[1].EffectiveFrom.Equal(t1) || prices[1].EffectiveTo != nil || prices[1].InputPrice != 3 {
+		t.Errorf("new version %+v, want price 3 current from %v", prices[1], t1)
+	}
+}
+
+func TestGetModelPricingAt(t *testing.T) {
+	useTestDB(t)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(24 * time.Hour)
+	storePrice(t, 1, t0)
+	storePrice(t, 3, t1)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want float64
+	}{
+		{"before the first version", t0.Add(-time.Hour), 1},
+		{"first version", t0.Add(time.Hour), 1},
+		{"on the effective_to boundary", t1, 3},
+		{"just before the boundary", t1.Add(-time.Millisecond), 1},
+		{"current version", t1.Add(time.Hour), 3},
+		{"in another time zone", t1.Add(time.Hour).In(time.FixedZone("UTC+5", 5*3600)), 3},
+	}
+	for _, tc := range tests {
+		price, err := GetModelPricing("m", tc.at)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if price.InputPrice != tc.want {
+			t.Errorf("%s: got price %v, want %v", tc.name, price.InputPrice, tc.want)
+		}
+	}
+}
+
+func TestUsageAccuracy(t *testing.T) {
+	tests := []struct {
+		source, model, want string
+	}{
+		{"reported", "claude-x", "exact"},
+		{"estimated", "gpt-4o", "approximate"},
+		{"estimated", "claude-x", "approximate"},
+	}
+	for _, tc := range tests {
+		requestLog := &models.RequestLog{UsageSource: tc.source, ModelName: tc.model}
+		if got := usageAccuracy(requestLog); got != tc.want {
+			t.Errorf("%s usage of %s: got %s, want %s", tc.source, tc.model, got, tc.want)
+		}
+	}
+}
+
+func TestBudgetSpendAcrossTimeZones(t *testing.T) {
+	useTestDB(t)
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	east := time.FixedZone("UTC+5", 5*3600)
+	west := time.FixedZone("UTC-5", -5*3600)
+
+	for _, requestLog := range []models.RequestLog{
+		{KeyID: 1, Cost: 1, Timestamp: now.Add(-13 * time.Hour).In(east)},
+		{KeyID: 1, Cost: 2, Timestamp: now.Add(-11 * time.Hour).In(east)},
+		{KeyID: 1, Cost: 4, Timestamp: now.Add(-11 * time.Hour).In(west)},
+		{KeyID: 1, Cost: 8, Timestamp: now.Add(-13 * time.Hour).In(west)},
+	} {
+		if err := DB.Create(&requestLog).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spend, err := BudgetSpend(models.Budget{KeyID: 1, Period: "daily"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spend != 6 {
+		t.Errorf("got spend %v, want 6 from the requests since midnight UTC", spend)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// virtualKeyPrefix marks keys issued by the gateway
+const virtualKeyPrefix = "sk-gw-"
+
+// HashKey returns the hex SHA-256 of a key as stored in the database
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateVirtualKey issues a new virtual key. The key itself is only returned
+// here and cannot be recovered later.
+func CreateVirtualKey(name string, project string) (string, *models.VirtualKey, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", nil, fmt.Errorf("error generating key: %v", err)
+	}
+	key := virtualKeyPrefix + hex.EncodeToString(bytes)
+
+	virtualKey := &models.VirtualKey{
+		Name:      name,
+		Project:   project,
+		KeyHash:   HashKey(key),
+		KeyPrefix: key[:len(virtualKeyPrefix)+6],
+	}
+
+	result := DB.Create(virtualKey)
+	if result.Error != nil {
+		return "", nil, result.Error
+	}
+	return key, virtualKey, nil
+}
+
+// FindVirtualKey looks up an active key and records its use. It returns an
+// error for unknown and revoked keys.
+func FindVirtualKey(key string) (*models.VirtualKey, error) {
+	var virtualKey models.VirtualKey
+	result := DB.Where("key_hash = ? AND revoked_at IS NULL", HashKey(key)).First(&virtualKey)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	now := time.Now()
+	virtualKey.LastUsedAt = &now
+	if err := DB.Model(&virtualKey).Update("last_used_at", now).Error; err != nil {
+		return nil, err
+	}
+	return &virtualKey, nil
+}
+
+// ListVirtualKeys returns all keys, newest first
+func ListVirtualKeys() ([]models.VirtualKey, error) {
+	var keys []models.VirtualKey
+	result := DB.Order("created_at DESC").Find(&keys)
+	return keys, result.Error
+}
+
+// RevokeVirtualKey revokes a key so that requests using it are rejected
+func RevokeVirtualKey(id uint) (*models.VirtualKey, error) {
+	var virtualKey models.VirtualKey
+	if result := DB.First(&virtualKey, id); result.Error != nil {
+		return nil, result.Error
+	}
+
+	if virtualKey.RevokedAt == nil {
+		now := time.Now()
+		virtualKey.RevokedAt = &now
+		if err := DB.Model(&virtualKey).Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &virtualKey, nil
+}
@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/converter"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/token_counter"
+)
+
+// newAnthropicRequest builds a request to the Messages endpoint of an
+// Anthropic provider
+func newAnthropicRequest(r *http.Request, config config.Config, provider config.Provider, body []byte) (*http.Request, error) {
+	// BaseURL doesn't have "/" in the end as it's trimmed in config.go
+	url := provider.BaseURL + "/messages"
+	log.Printf("Forwarding Anthropic request to %s: %s", url, string(body))
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	setAnthropicAuth(req, r, provider)
+
+	version := r.Header.Get("anthropic-version")
+	if version == "" {
+		version = config.AnthropicVersion
+	}
+	req.Header.Set("anthropic-version", version)
+
+	if beta := r.Header.Get("anthropic-beta"); beta != "" {
+		req.Header.Set("anthropic-beta", beta)
+	}
+
+	return req, nil
+}
+
+// anthropicUsageJSON creates the usage JSON for the request log from Anthropic
+// usage, counting cached prompt tokens as input
+func anthropicUsageJSON(usage models.AnthropicUsage, requestType string) (string, error) {
+	openaiUsage := converter.OpenAIUsage(usage)
+	return token_counter.CreateUsageJSON(openaiUsage.PromptTokens, openaiUsage.CompletionTokens, requestType)
+}
+
+// relayAnthropicResponse writes the response of an Anthropic provider to an
+// Anthropic client unchanged and logs it
+func relayAnthropicResponse(w http.ResponseWriter, resp *http.Response, anthropicReq models.AnthropicRequest, requestLog *models.RequestLog, startTime time.Time) {
+	log.Printf("Response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
+
+	for key, values := range resp.Header {
+		// Streams are re-framed line by line, so the length may change
+		if key == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if anthropicReq.Stream && resp.StatusCode == http.StatusOK {
+		passthroughAnthropicStream(w, resp, requestLog, startTime)
+		return
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		if responseClientGone(resp) {
+			logClientCancelled(requestLog, startTime, string(responseBody), "")
+			return
+		}
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, "Error reading response body: "+err.Error(), processingTime, "")
+		}
+		return
+	}
+
+	if _, err := w.Write(responseBody); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+
+	if requestLog == nil {
+		return
+	}
+
+	processingTime := time.Since(startTime).Milliseconds()
+
+	var usageJSON string
+	var anthropicResp models.AnthropicResponse
+	if resp.StatusCode == http.StatusOK && json.Unmarshal(responseBody, &anthropicResp) == nil {
+		usageJSON, err = anthropicUsageJSON(anthropicResp.Usage, "anthropic")
+		if err != nil {
+			log.Printf("Error creating usage JSON: %v", err)
+		} else {
+			requestLog.UsageSource = "reported"
+		}
+	}
+
+	db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(responseBody), processingTime, usageJSON)
+}
+
+// passthroughAnthropicStream copies an Anthropic SSE stream to the client
+// unchanged while collecting the output and usage for the request log
+func passthroughAnthropicStream(w http.ResponseWriter, resp *http.Response, requestLog *models.RequestLog, startTime time.Time) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming not supported by the response writer")
+		return
+	}
+
+	var output strings.Builder
+	var usage models.AnthropicUsage
+	writeFailed := false
+
+	// failure is the upstream error event that ended the stream, if any
+	var failure string
+	var failureStatus int
+	complete := false // message_stop was received
+	message := newMessageAssembler()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			log.Printf("Error writing to response: %v", err)
+			writeFailed = true
+			break
+		}
+		if line == "" {
+			flusher.Flush()
+			continue
+		}
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		var event models.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.Printf("Error parsing Anthropic event: %v", err)
+			continue
+		}
+		collectAnthropicEvent(event, &output, &usage)
+		message.add([]byte(data))
+		if event.Type == "message_stop" {
+			complete = true
+		}
+		if event.Type == "error" {
+			// The client has the error event already, only the log needs it
+			log.Printf("Error event from upstream: %s", data)
+			failure = data
+			failureStatus, _, _ = parseAnthropicStreamError(data)
+		}
+	}
+	flusher.Flush()
+
+	if writeFailed || (scanner.Err() != nil && responseClientGone(resp)) {
+		var usageJSON string
+		if requestLog != nil {
+			estimatePartialOutput(&usage, output.String(), requestLog.ModelName)
+			requestLog.UsageSource = "estimated"
+			var err error
+			if usageJSON, err = anthropicUsageJSON(usage, "anthropic"); err != nil {
+				log.Printf("Error creating usage JSON: %v", err)
+			}
+		}
+		logClientCancelled(requestLog, startTime, output.String(), usageJSON)
+		return
+	}
+
+	if failure != "" {
+		recordStreamOutcome(resp, failureStatus < 500)
+	} else {
+		recordStreamOutcome(resp, scanner.Err() == nil && complete)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading from response: %v", err)
+		responseBody := writeAnthropicStreamError(w, flusher, "api_error", "Error reading from upstream: "+err.Error())
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	if failure != "" {
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, failureStatus, resp.Header, failure, processingTime, "")
+		}
+		return
+	}
+
+	if !complete {
+		log.Printf("Upstream stream ended without message_stop")
+		responseBody := writeAnthropicStreamError(w, flusher, "api_error", incompleteStreamMessage)
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	log.Printf("Completed streaming response")
+	if requestLog == nil {
+		return
+	}
+
+	processingTime := time.Since(startTime).Milliseconds()
+
+	usageJSON, err := anthropicUsageJSON(usage, "anthropic")
+	if err != nil {
+		log.Printf("Error creating usage JSON: %v", err)
+	} else {
+		requestLog.UsageSource = "reported"
+	}
+
+	requestLog.StreamedResponse = message.response()
+	db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, output.String(), processingTime, usageJSON)
+}
+
+// collectAnthropicEvent accumulates the output text and usage of an Anthropic
+// stream. Input usage arrives in message_start and the final output usage in
+// message_delta.
+func collectAnthropicEvent(event models.AnthropicStreamEvent, output *strings.Builder, usage *models.AnthropicUsage) {
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			*usage = event.Message.Usage
+		}
+	case "content_block_delta":
+		output.WriteString(event.Delta.Text)
+		output.WriteString(event.Delta.PartialJson)
+	case "message_delta":
+		if event.Usage != nil {
+			usage.OutputTokens = event.Usage.OutputTokens
+			if event.Usage.InputTokens > 0 {
+				usage.InputTokens = event.Usage.InputTokens
+			}
+		}
+	}
+}
+
+// relayAnthropicAsOpenAI converts the response or stream of an Anthropic
+// provider into an OpenAI chat completion for an OpenAI client
+func relayAnthropicAsOpenAI(w http.ResponseWriter, resp *http.Response, openaiReq models.OpenAIRequest, requestLog *models.RequestLog, startTime time.Time) {
+	log.Printf("Response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+
+		// Re-shape the Anthropic error so OpenAI SDKs can parse it
+		var upstreamError anthropicError
+		if err := json.Unmarshal(responseBody, &upstreamError); err == nil && upstreamError.Error.Message != "" {
+			responseBody = []byte(writeOpenAIError(w, resp.StatusCode, upstreamError.Error.Type, upstreamError.Error.Message))
+		} else {
+			w.WriteHeader(resp.StatusCode)
+			w.Write(responseBody)
+		}
+
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(responseBody), processingTime, "")
+		}
+		return
+	}
+
+	if openaiReq.Stream {
+		translateAnthropicStream(w, resp, requestLog, openaiReq, startTime)
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if responseClientGone(resp) {
+			logClientCancelled(requestLog, startTime, string(body), "")
+			return
+		}
+		responseBody := writeOpenAIError(w, http.StatusBadGateway, "api_error", "Error reading response body")
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	var anthropicResp models.AnthropicResponse
+	if err := json.Unmarshal(body, &anthropicResp); err != nil {
+		log.Printf("Error parsing Anthropic response: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "Error parsing upstream response")
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, string(body), processingTime, "")
+		}
+		return
+	}
+
+	openaiResp := converter.ConvertToOpenAIResponse(anthropicResp)
+
+	responseJSON, err := json.Marshal(openaiResp)
+	if err != nil {
+		log.Printf("Error encoding OpenAI response: %v", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "Error encoding response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(responseJSON); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+
+	if requestLog != nil {
+		processingTime := time.Since(startTime).Milliseconds()
+		usageJSON, err := anthropicUsageJSON(anthropicResp.Usage, "openai")
+		if err != nil {
+			log.Printf("Error creating usage JSON: %v", err)
+		} else {
+			requestLog.UsageSource = "reported"
+		}
+		db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, string(responseJSON), processingTime, usageJSON)
+	}
+}
+
+// translateAnthropicStream converts an Anthropic SSE stream into OpenAI chat
+// completion chunks. Each tool_use block becomes a tool call with its own
+// index, and the usage chunk is only sent when the client asked for it.
+func translateAnthropicStream(w http.ResponseWriter, resp *http.Response, requestLog *models.RequestLog, openaiReq models.OpenAIRequest, startTime time.Time) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming not supported by the response writer")
+		return
+	}
+
+	var output strings.Builder
+	var usage models.AnthropicUsage
+	writeFailed := false
+
+	chunkID := "chatcmpl-" + db.GenerateRandomID()
+	model := openaiReq.Model
+	created := time.Now().Unix()
+
+	// toolCalls maps an Anthropic block index to its OpenAI tool call index
+	toolCalls := make(map[int]int)
+
+	// failure is the error chunk sent for an upstream error event, with the
+	// status it is logged with
+	var failure string
+	var failureStatus int
+	complete := false // message_stop was received
+	completion := newCompletionAssembler()
+
+	writeChunk := func(chunk models.OpenAIStreamingChunk) error {
+		chunk.Id = chunkID
+		chunk.Object = "chat.completion.chunk"
+		chunk.Created = created
+		chunk.Model = model
+		if chunk.Choices == nil {
+			chunk.Choices = []models.OpenAIStreamingChoice{}
+		}
+
+		chunkJSON, err := json.Marshal(chunk)
+		if err != nil {
+			log.Printf("Error marshaling OpenAI chunk: %v", err)
+			return err
+		}
+		if _, err := w.Write([]byte("data: " + string(chunkJSON) + "\n\n")); err != nil {
+			log.Printf("Error writing to response: %v", err)
+			return err
+		}
+		flusher.Flush()
+		completion.add(chunk)
+		return nil
+	}
+	writeDelta := func(delta models.OpenAIDelta, finishReason *string) error {
+		return writeChunk(models.OpenAIStreamingChunk{
+			Choices: []models.OpenAIStreamingChoice{
+				{Index: 0, Delta: delta, FinishReason: finishReason},
+			},
+		})
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event models.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.Printf("Error parsing Anthropic event: %v", err)
+			continue
+		}
+		collectAnthropicEvent(event, &output, &usage)
+
+		var err error
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil && event.Message.Model != "" {
+				model = event.Message.Model
+			}
+			err = writeDelta(models.OpenAIDelta{Role: "assistant"}, nil)
+		case "content_block_start":
+			if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+				index := len(toolCalls)
+				toolCalls[event.Index] = index
+				err = writeDelta(models.OpenAIDelta{
+					ToolCalls: []models.OpenAIStreamingToolCall{
+						{
+							Index: index,
+							Id:    event.ContentBlock.Id,
+							Type:  "function",
+							Function: models.OpenAIFunctionCall{
+								Name: event.ContentBlock.Name,
+							},
+						},
+					},
+				}, nil)
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				err = writeDelta(models.OpenAIDelta{Content: event.Delta.Text}, nil)
+			case "input_json_delta":
+				if event.Delta.PartialJson != "" {
+					err = writeDelta(models.OpenAIDelta{
+						ToolCalls: []models.OpenAIStreamingToolCall{
+							{
+								Index: toolCalls[event.Index],
+								Function: models.OpenAIFunctionCall{
+									Arguments: event.Delta.PartialJson,
+								},
+							},
+						},
+					}, nil)
+				}
+			}
+		case "message_delta":
+			finishReason := converter.ConvertFinishReason(event.Delta.StopReason)
+			err = writeDelta(models.OpenAIDelta{}, &finishReason)
+		case "message_stop":
+			complete = true
+			if openaiReq.StreamOptions != nil && openaiReq.StreamOptions.IncludeUsage {
+				openaiUsage := converter.OpenAIUsage(usage)
+				err = writeChunk(models.OpenAIStreamingChunk{Usage: &openaiUsage})
+			}
+			if err == nil {
+				_, err = w.Write([]byte("data: [DONE]\n\n"))
+				flusher.Flush()
+			}
+		case "error":
+			log.Printf("Error event from upstream: %s", data)
+			var errorType, message string
+			failureStatus, errorType, message = parseAnthropicStreamError(data)
+			failure = writeOpenAIStreamError(w, flusher, errorType, message)
+		}
+
+		if err != nil {
+			writeFailed = true
+			break
+		}
+		if failure != "" {
+			break
+		}
+	}
+
+	if writeFailed || (scanner.Err() != nil && responseClientGone(resp)) {
+		var usageJSON string
+		if requestLog != nil {
+			estimatePartialOutput(&usage, output.String(), requestLog.ModelName)
+			requestLog.UsageSource = "estimated"
+			var err error
+			if usageJSON, err = anthropicUsageJSON(usage, "openai"); err != nil {
+				log.Printf("Error creating usage JSON: %v", err)
+			}
+		}
+		logClientCancelled(requestLog, startTime, output.String(), usageJSON)
+		return
+	}
+
+	if failure != "" {
+		recordStreamOutcome(resp, failureStatus < 500)
+	} else {
+		recordStreamOutcome(resp, scanner.Err() == nil && complete)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading from response: %v", err)
+		responseBody := writeOpenAIStreamError(w, flusher, "server_error", "Error reading from upstream: "+err.Error())
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	if failure != "" {
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, failureStatus, resp.Header, failure, processingTime, "")
+		}
+		return
+	}
+
+	if !complete {
+		log.Printf("Upstream stream ended without message_stop")
+		responseBody := writeOpenAIStreamError(w, flusher, "server_error", incompleteStreamMessage)
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	log.Printf("Completed streaming response")
+	if requestLog != nil {
+		processingTime := time.Since(startTime).Milliseconds()
+		usageJSON, err := anthropicUsageJSON(usage, "openai")
+		if err != nil {
+			log.Printf("Error creating usage JSON: %v", err)
+		} else {
+			requestLog.UsageSource = "reported"
+		}
+		completion.setUsage(converter.OpenAIUsage(usage))
+		requestLog.StreamedResponse = completion.response()
+		db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, output.String(), processingTime, usageJSON)
+	}
+}
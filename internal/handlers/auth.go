@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"gorm.io/gorm"
+)
+
+// clientKey returns the key sent by the client as x-api-key or as a bearer
+// token
+func clientKey(r *http.Request) string {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// authenticate checks the client's virtual key when virtual keys are
+// required. The key is removed from the request, so it is neither forwarded
+// upstream nor stored in the request log. It returns nil without checking
+// anything when virtual keys are disabled.
+func authenticate(r *http.Request, config config.Config) (*models.VirtualKey, error) {
+	if !config.VirtualKeys {
+		return nil, nil
+	}
+
+	key := clientKey(r)
+	r.Header.Del("x-api-key")
+	r.Header.Del("Authorization")
+	if key == "" {
+		return nil, errors.New("missing API key, set the x-api-key header")
+	}
+
+	virtualKey, err := db.FindVirtualKey(key)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error looking up virtual key: %v", err)
+		}
+		return nil, errors.New("invalid x-api-key")
+	}
+	return virtualKey, nil
+}
+
+// virtualKeyResponse is a virtual key as returned by the admin API. Key is
+// only set when the key is created.
+type virtualKeyResponse struct {
+	ID        uint   `json:"id"`
+	Key       string `json:"key,omitempty"`
+	KeyPrefix string `json:"key_prefix"`
+	Name      string `json:"name"`
+	Project   string `json:"project,omitempty"`
+	CreatedAt string `json:"created_at"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+	LastUsed  string `json:"last_used_at,omitempty"`
+}
+
+func newVirtualKeyResponse(virtualKey models.VirtualKey) virtualKeyResponse {
+	response := virtualKeyResponse{
+		ID:        virtualKey.ID,
+		KeyPrefix: virtualKey.KeyPrefix,
+		Name:      virtualKey.Name,
+		Project:   virtualKey.Project,
+		CreatedAt: virtualKey.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if virtualKey.RevokedAt != nil {
+		response.RevokedAt = virtualKey.RevokedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if virtualKey.LastUsedAt != nil {
+		response.LastUsed = virtualKey.LastUsedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return response
+}
+
+// checkAdmin verifies the admin bearer token and writes an error otherwise
+func checkAdmin(w http.ResponseWriter, r *http.Request, config config.Config) bool {
+	if config.AdminToken == "" {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", "Admin API is disabled, set -admin-token to enable it")
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", "invalid admin token")
+		return false
+	}
+	return true
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleAdminKeys lists virtual keys (GET) and issues new ones (POST) on
+// /admin/keys
+func HandleAdminKeys(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if !checkAdmin(w, r, config) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := db.ListVirtualKeys()
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error listing keys: "+err.Error())
+			return
+		}
+
+		response := struct {
+			Data []virtualKeyResponse `json:"data"`
+		}{
+			Data: make([]virtualKeyResponse, 0, len(keys)),
+		}
+		for _, key := range keys {
+			response.Data = append(response.Data, newVirtualKeyResponse(key))
+		}
+		writeJSON(w, http.StatusOK, response)
+
+	case http.MethodPost:
+		var createReq struct {
+			Name    string `json:"name"`
+			Project string `json:"project"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil || createReq.Name == "" {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", `Request body must be JSON with a "name"`)
+			return
+		}
+
+		key, virtualKey, err := db.CreateVirtualKey(createReq.Name, createReq.Project)
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error creating key: "+err.Error())
+			return
+		}
+		log.Printf("Issued virtual key %d (%s) for %s", virtualKey.ID, virtualKey.KeyPrefix, virtualKey.Name)
+
+		response := newVirtualKeyResponse(*virtualKey)
+		response.Key = key
+		writeJSON(w, http.StatusCreated, response)
+
+	default:
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+	}
+}
+
+// HandleAdminKey revokes a virtual key with DELETE /admin/keys/{id}
+func HandleAdminKey(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if !checkAdmin(w, r, config) {
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/keys/"), 10, 64)
+	if err != nil {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", "Key not found")
+		return
+	}
+
+	virtualKey, err := db.RevokeVirtualKey(uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeAnthropicError(w, http.StatusNotFound, "not_found_error", "Key not found")
+			return
+		}
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error revoking key: "+err.Error())
+		return
+	}
+	log.Printf("Revoked virtual key %d (%s)", virtualKey.ID, virtualKey.KeyPrefix)
+
+	writeJSON(w, http.StatusOK, newVirtualKeyResponse(*virtualKey))
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// budgetScope describes what a budget applies to, for messages and headers
+func budgetScope(budget models.Budget) string {
+	if budget.KeyID != 0 {
+		return fmt.Sprintf("%s budget of key %d", budget.Period, budget.KeyID)
+	}
+	return fmt.Sprintf("%s budget of project %s", budget.Period, budget.Project)
+}
+
+// checkBudgets compares the spend of a key and its project with their
+// budgets. It returns an error naming the first exhausted budget, and adds a
+// warning header for every budget past its soft limit. Budgets are not
+// enforced when the spend cannot be read, so a database problem does not
+// block all traffic.
+func checkBudgets(w http.ResponseWriter, virtualKey *models.VirtualKey) error {
+	if virtualKey == nil {
+		return nil
+	}
+
+	budgets, err := db.BudgetsForKey(virtualKey)
+	if err != nil {
+		log.Printf("Error loading budgets: %v", err)
+		return nil
+	}
+
+	now := time.Now()
+	for _, budget := range budgets {
+		spend, err := db.BudgetSpend(budget, now)
+		if err != nil {
+			log.Printf("Error calculating spend for budget %d: %v", budget.ID, err)
+			continue
+		}
+
+		resets := "never"
+		if reset := db.NextReset(budget.Period, now); !reset.IsZero() {
+			resets = reset.Format(time.RFC3339)
+		}
+
+		if spend >= budget.LimitUSD {
+			return fmt.Errorf("%s exhausted: $%.4f spent of $%.2f, resets %s", budgetScope(budget), spend, budget.LimitUSD, resets)
+		}
+		if spend >= budget.LimitUSD*budget.WarnAt {
+			w.Header().Add("x-gateway-budget-warning", fmt.Sprintf("%s %.0f%% used ($%.4f of $%.2f), resets %s",
+				budgetScope(budget), spend/budget.LimitUSD*100, spend, budget.LimitUSD, resets))
+		}
+	}
+	return nil
+}
+
+// budgetResponse is a budget as returned by the admin API, with the spend in
+// the current period
+type budgetResponse struct {
+	ID       uint    `json:"id"`
+	KeyID    uint    `json:"key_id,omitempty"`
+	Project  string  `json:"project,omitempty"`
+	Period   string  `json:"period"`
+	LimitUSD float64 `json:"limit_usd"`
+	WarnAt   float64 `json:"warn_at"`
+	SpentUSD float64 `json:"spent_usd"`
+	ResetsAt string  `json:"resets_at,omitempty"`
+}
+
+func newBudgetResponse(budget models.Budget) budgetResponse {
+	now := time.Now()
+	response := budgetResponse{
+		ID:       budget.ID,
+		KeyID:    budget.KeyID,
+		Project:  budget.Project,
+		Period:   budget.Period,
+		LimitUSD: budget.LimitUSD,
+		WarnAt:   budget.WarnAt,
+	}
+
+	spend, err := db.BudgetSpend(budget, now)
+	if err != nil {
+		log.Printf("Error calculating spend for budget %d: %v", budget.ID, err)
+	}
+	response.SpentUSD = spend
+
+	if reset := db.NextReset(budget.Period, now); !reset.IsZero() {
+		response.ResetsAt = reset.Format(time.RFC3339)
+	}
+	return response
+}
+
+// HandleAdminBudgets lists budgets (GET) and creates them (POST) on
+// /admin/budgets
+func HandleAdminBudgets(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if !checkAdmin(w, r, config) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		budgets, err := db.ListBudgets()
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error listing budgets: "+err.Error())
+			return
+		}
+
+		response := struct {
+			Data []budgetResponse `json:"data"`
+		}{
+			Data: make([]budgetResponse, 0, len(budgets)),
+		}
+		for _, budget := range budgets {
+			response.Data = append(response.Data, newBudgetResponse(budget))
+		}
+		writeJSON(w, http.StatusOK, response)
+
+	case http.MethodPost:
+		var createReq struct {
+			KeyID    uint    `json:"key_id"`
+			Project  string  `json:"project"`
+			Period   string  `json:"period"`
+			LimitUSD float64 `json:"limit_usd"`
+			WarnAt   float64 `json:"warn_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error parsing request JSON")
+			return
+		}
+
+		budget := models.Budget{
+			KeyID:    createReq.KeyID,
+			Project:  createReq.Project,
+			Period:   createReq.Period,
+			LimitUSD: createReq.LimitUSD,
+			WarnAt:   createReq.WarnAt,
+		}
+		if err := db.CreateBudget(&budget); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		log.Printf("Created %s", budgetScope(budget))
+
+		writeJSON(w, http.StatusCreated, newBudgetResponse(budget))
+
+	default:
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+	}
+}
+
+// HandleAdminBudget deletes a budget with DELETE /admin/budgets/{id}
+func HandleAdminBudget(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if !checkAdmin(w, r, config) {
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/budgets/"), 10, 64)
+	if err != nil {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", "Budget not found")
+		return
+	}
+
+	if err := db.DeleteBudget(uint(id)); err != nil {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,563 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/cache"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// responseCacheKey returns the cache key of a request, or "" when the cache
+// is disabled or the request may not be cached
+func responseCacheKey(r *http.Request, requestType string, openaiReq models.OpenAIRequest) string {
+	if !cache.Enabled() || !cache.Eligible(openaiReq.Temperature, r.Header.Get(cache.Header)) {
+		return ""
+	}
+
+	key, err := cache.Key(requestType, openaiReq)
+	if err != nil {
+		log.Printf("Error computing cache key: %v", err)
+		return ""
+	}
+	return key
+}
+
+// rawResponseCacheKey is responseCacheKey for requests whose body is sent
+// to the upstream unchanged, which are keyed on that body
+func rawResponseCacheKey(r *http.Request, requestType string, temperature *float64, body []byte) string {
+	if !cache.Enabled() || !cache.Eligible(temperature, r.Header.Get(cache.Header)) {
+		return ""
+	}
+
+	key, err := cache.RawKey(requestType, body)
+	if err != nil {
+		log.Printf("Error computing cache key: %v", err)
+		return ""
+	}
+	return key
+}
+
+// serveCached answers a request from the cache as JSON or, for streaming
+// requests, as a synthesized stream. It returns false on a cache miss.
+func serveCached(w http.ResponseWriter, key string, requestLog *models.RequestLog, requestType string, stream bool, includeUsage bool) bool {
+	startTime := time.Now()
+
+	entry, ok := cache.Get(key)
+	if !ok {
+		w.Header().Set(cache.Header, "miss")
+		return false
+	}
+	log.Printf("Serving cached response %s from %s", key[:12], entry.CreatedAt.Format(time.RFC3339))
+	w.Header().Set(cache.Header, "hit")
+
+	var err error
+	switch {
+	case !stream:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write([]byte(entry.Body))
+	case requestType == "anthropic":
+		err = replayAnthropicStream(w, entry.Body)
+	default:
+		err = replayOpenAIStream(w, entry.Body, includeUsage)
+	}
+	if err != nil {
+		log.Printf("Error replaying cached response: %v", err)
+	}
+
+	if requestLog != nil {
+		requestLog.CacheHit = true
+		requestLog.Provider = entry.Provider
+		requestLog.UsageSource = entry.UsageSource
+		processingTime := time.Since(startTime).Milliseconds()
+		db.UpdateResponseLog(requestLog, http.StatusOK, w.Header(), entry.Body, processingTime, entry.Usage)
+	}
+	return true
+}
+
+// storeCachedResponse caches the response logged for a request. Only
+// successful responses are stored. Streams are stored as the complete
+// response assembled from them, so that both JSON and stream replays can be
+// built from any entry.
+func storeCachedResponse(key string, requestLog *models.RequestLog, stream bool) {
+	if key == "" || requestLog == nil || requestLog.ResponseStatus != http.StatusOK {
+		return
+	}
+
+	body := requestLog.ResponseBody
+	if stream {
+		body = requestLog.StreamedResponse
+	}
+	if !hasStopReason(body) {
+		log.Printf("Not caching a response without a stop reason")
+		return
+	}
+
+	cache.Put(key, cache.Entry{
+		Body:        body,
+		Usage:       requestLog.Usage,
+		UsageSource: requestLog.UsageSource,
+		Provider:    requestLog.Provider,
+	})
+}
+
+// hasStopReason reports whether a message has a stop_reason, or every choice
+// of a chat completion a finish_reason. Replays need one, and a response
+// without it was cut off.
+func hasStopReason(body string) bool {
+	var response struct {
+		StopReason string `json:"stop_reason"`
+		Choices    []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return false
+	}
+	if len(response.Choices) == 0 {
+		return response.StopReason != ""
+	}
+	for _, choice := range response.Choices {
+		if choice.FinishReason == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// messageAssembler rebuilds the Anthropic message of a stream from its
+// events. Messages are kept as generic JSON so that block types and fields
+// the gateway does not model, such as thinking blocks, survive. A nil
+// assembler ignores everything, for when the cache is disabled.
+type messageAssembler struct {
+	message map[string]interface{}
+	blocks  []map[string]interface{}
+	inputs  map[int]*strings.Builder // partial_json of tool_use blocks
+}
+
+// newMessageAssembler returns an assembler when the response cache is in use
+func newMessageAssembler() *messageAssembler {
+	if !cache.Enabled() {
+		return nil
+	}
+	return &messageAssembler{inputs: make(map[int]*strings.Builder)}
+}
+
+// add applies the data of a stream event
+func (a *messageAssembler) add(data []byte) {
+	if a == nil {
+		return
+	}
+
+	var event struct {
+		Type         string                 `json:"type"`
+		Index        int                    `json:"index"`
+		Message      map[string]interface{} `json:"message"`
+		ContentBlock map[string]interface{} `json:"content_block"`
+		Delta        map[string]interface{} `json:"delta"`
+		Usage        map[string]interface{} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+
+	var block map[string]interface{}
+	if event.Index >= 0 && event.Index < len(a.blocks) {
+		block = a.blocks[event.Index]
+	}
+
+	switch event.Type {
+	case "message_start":
+		a.message = event.Message
+	case "content_block_start":
+		for len(a.blocks) <= event.Index {
+			a.blocks = append(a.blocks, nil)
+		}
+		a.blocks[event.Index] = event.ContentBlock
+	case "content_block_delta":
+		if block == nil {
+			return
+		}
+		switch event.Delta["type"] {
+		case "text_delta":
+			block["text"] = appendText(block["text"], event.Delta["text"])
+		case "thinking_delta":
+			block["thinking"] = appendText(block["thinking"], event.Delta["thinking"])
+		case "signature_delta":
+			block["signature"] = event.Delta["signature"]
+		case "citations_delta":
+			citations, _ := block["citations"].([]interface{})
+			block["citations"] = append(citations, event.Delta["citation"])
+		case "input_json_delta":
+			if a.inputs[event.Index] == nil {
+				a.inputs[event.Index] = &strings.Builder{}
+			}
+			partial, _ := event.Delta["partial_json"].(string)
+			a.inputs[event.Index].WriteString(partial)
+		}
+	case "content_block_stop":
+		if input := a.inputs[event.Index]; block != nil && input != nil && input.Len() > 0 {
+			block["input"] = json.RawMessage(input.String())
+		}
+	case "message_delta":
+		if a.message == nil {
+			return
+		}
+		for field, value := range event.Delta {
+			a.message[field] = value
+		}
+		usage, _ := a.message["usage"].(map[string]interface{})
+		if usage == nil {
+			usage = make(map[string]interface{})
+		}
+		for field, value := range event.Usage {
+			usage[field] = value
+		}
+		a.message["usage"] = usage
+	}
+}
+
+// response returns the assembled message as JSON, or "" when there is none
+func (a *messageAssembler) response() string {
+	if a == nil || a.message == nil {
+		return ""
+	}
+
+	content := make([]interface{}, 0, len(a.blocks))
+	for _, block := range a.blocks {
+		if block != nil {
+			content = append(content, block)
+		}
+	}
+	a.message["content"] = content
+
+	messageJSON, err := json.Marshal(a.message)
+	if err != nil {
+		log.Printf("Error encoding streamed message: %v", err)
+		return ""
+	}
+	return string(messageJSON)
+}
+
+// appendText appends a text delta to a string field of a block
+func appendText(field interface{}, delta interface{}) string {
+	text, _ := field.(string)
+	deltaText, _ := delta.(string)
+	return text + deltaText
+}
+
+// completionAssembler rebuilds the chat completion of a stream from its
+// chunks. A nil assembler ignores everything, for when the cache is
+// disabled.
+type completionAssembler struct {
+	completion models.OpenAIResponse
+	content    map[int]*strings.Builder // by choice index
+}
+
+// newCompletionAssembler returns an assembler when the response cache is in
+// use
+func newCompletionAssembler() *completionAssembler {
+	if !cache.Enabled() {
+		return nil
+	}
+	return &completionAssembler{content: make(map[int]*strings.Builder)}
+}
+
+// add applies a chunk
+func (a *completionAssembler) add(chunk models.OpenAIStreamingChunk) {
+	if a == nil {
+		return
+	}
+
+	if a.completion.Id == "" {
+		a.completion.Id = chunk.Id
+		a.completion.Created = chunk.Created
+		a.completion.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		a.completion.Usage = *chunk.Usage
+	}
+
+	for _, delta := range chunk.Choices {
+		choice := a.choice(delta.Index)
+		a.content[delta.Index].WriteString(delta.Delta.Content)
+
+		for _, fragment := range delta.Delta.ToolCalls {
+			for len(choice.Message.ToolCalls) <= fragment.Index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, models.OpenAIToolCall{Type: "function"})
+			}
+			toolCall := &choice.Message.ToolCalls[fragment.Index]
+			if fragment.Id != "" {
+				toolCall.Id = fragment.Id
+			}
+			if fragment.Type != "" {
+				toolCall.Type = fragment.Type
+			}
+			toolCall.Function.Name += fragment.Function.Name
+			toolCall.Function.Arguments += fragment.Function.Arguments
+		}
+
+		if delta.FinishReason != nil && *delta.FinishReason != "" {
+			choice.FinishReason = *delta.FinishReason
+		}
+		if len(delta.StopReason) > 0 {
+			choice.StopReason = delta.StopReason
+		}
+		if len(delta.MatchedStop) > 0 {
+			choice.MatchedStop = delta.MatchedStop
+		}
+	}
+}
+
+// choice returns the choice with an index, adding it on first use
+func (a *completionAssembler) choice(index int) *models.OpenAIChoice {
+	for i := range a.completion.Choices {
+		if a.completion.Choices[i].Index == index {
+			return &a.completion.Choices[i]
+		}
+	}
+	a.completion.Choices = append(a.completion.Choices, models.OpenAIChoice{
+		Index:   index,
+		Message: models.OpenAIMessage{Role: "assistant"},
+	})
+	a.content[index] = &strings.Builder{}
+	return &a.completion.Choices[len(a.completion.Choices)-1]
+}
+
+// setUsage fills in the usage when the upstream did not report it
+func (a *completionAssembler) setUsage(usage models.OpenAIUsage) {
+	if a != nil && a.completion.Usage.TotalTokens == 0 {
+		a.completion.Usage = usage
+	}
+}
+
+// response returns the assembled completion as JSON, or "" when there is
+// none
+func (a *completionAssembler) response() string {
+	if a == nil || len(a.completion.Choices) == 0 {
+		return ""
+	}
+
+	completion := a.completion
+	completion.Object = "chat.completion"
+	completion.Choices = append([]models.OpenAIChoice(nil), a.completion.Choices...)
+	sort.Slice(completion.Choices, func(i, j int) bool {
+		return completion.Choices[i].Index < completion.Choices[j].Index
+	})
+	for i := range completion.Choices {
+		completion.Choices[i].Message.Content = models.OpenAIContent{Text: a.content[completion.Choices[i].Index].String()}
+	}
+
+	completionJSON, err := json.Marshal(completion)
+	if err != nil {
+		log.Printf("Error encoding streamed completion: %v", err)
+		return ""
+	}
+	return string(completionJSON)
+}
+
+// replayAnthropicStream writes a cached Anthropic message as the event
+// sequence of a stream, with each content block sent as a single delta
+func replayAnthropicStream(w http.ResponseWriter, body string) error {
+	var message models.AnthropicResponse
+	if err := json.Unmarshal([]byte(body), &message); err != nil {
+		return err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errStreamingUnsupported
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	s := &streamWriter{w: w, flusher: flusher}
+
+	// A live stream starts with a null stop reason and stop sequence
+	start := struct {
+		models.AnthropicResponse
+		StopReason   *string `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	}{
+		AnthropicResponse: message,
+	}
+	start.Content = []models.AnthropicContent{}
+	start.Usage.OutputTokens = 1
+	err := s.writeEvent("message_start", struct {
+		Type    string      `json:"type"`
+		Message interface{} `json:"message"`
+	}{
+		Type:    "message_start",
+		Message: start,
+	})
+	if err != nil {
+		return err
+	}
+
+	for index, block := range message.Content {
+		startBlock := block
+		var delta *models.AnthropicDelta
+		switch block.Type {
+		case "text":
+			startBlock.Text = ""
+			delta = &models.AnthropicDelta{Type: "text_delta", Text: block.Text}
+		case "tool_use":
+			startBlock.Input = json.RawMessage("{}")
+			delta = &models.AnthropicDelta{Type: "input_json_delta", PartialJson: string(block.Input)}
+		}
+
+		err := s.writeEvent("content_block_start", struct {
+			Type         string                  `json:"type"`
+			Index        int                     `json:"index"`
+			ContentBlock models.AnthropicContent `json:"content_block"`
+		}{
+			Type:         "content_block_start",
+			Index:        index,
+			ContentBlock: startBlock,
+		})
+		if err != nil {
+			return err
+		}
+
+		if delta != nil {
+			err := s.writeEvent("content_block_delta", models.AnthropicStreamingChunk{
+				Type:  "content_block_delta",
+				Index: index,
+				Delta: *delta,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.writeEvent("content_block_stop", struct {
+			Type  string `json:"type"`
+			Index int    `json:"index"`
+		}{
+			Type:  "content_block_stop",
+			Index: index,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var stopSequence *string
+	if message.StopSequence != "" {
+		stopSequence = &message.StopSequence
+	}
+	err = s.writeEvent("message_delta", struct {
+		Type  string `json:"type"`
+		Delta struct {
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		} `json:"delta"`
+		Usage struct {
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}{
+		Type: "message_delta",
+		Delta: struct {
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		}{
+			StopReason:   message.StopReason,
+			StopSequence: stopSequence,
+		},
+		Usage: struct {
+			OutputTokens int `json:"output_tokens"`
+		}{
+			OutputTokens: message.Usage.OutputTokens,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.writeEvent("message_stop", struct {
+		Type string `json:"type"`
+	}{
+		Type: "message_stop",
+	})
+}
+
+// replayOpenAIStream writes a cached chat completion as a stream of chunks,
+// with each choice sent as a single delta followed by its finish reason
+func replayOpenAIStream(w http.ResponseWriter, body string, includeUsage bool) error {
+	var completion models.OpenAIResponse
+	if err := json.Unmarshal([]byte(body), &completion); err != nil {
+		return err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errStreamingUnsupported
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeChunk := func(choices []models.OpenAIStreamingChoice, usage *models.OpenAIUsage) error {
+		chunkJSON, err := json.Marshal(models.OpenAIStreamingChunk{
+			Id:      completion.Id,
+			Object:  "chat.completion.chunk",
+			Created: completion.Created,
+			Model:   completion.Model,
+			Choices: choices,
+			Usage:   usage,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("data: " + string(chunkJSON) + "\n\n")); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for _, choice := range completion.Choices {
+		delta := models.OpenAIDelta{
+			Role:    "assistant",
+			Content: choice.Message.Content.PlainText(),
+		}
+		for i, toolCall := range choice.Message.ToolCalls {
+			delta.ToolCalls = append(delta.ToolCalls, models.OpenAIStreamingToolCall{
+				Index:    i,
+				Id:       toolCall.Id,
+				Type:     toolCall.Type,
+				Function: toolCall.Function,
+			})
+		}
+		if err := writeChunk([]models.OpenAIStreamingChoice{{Index: choice.Index, Delta: delta}}, nil); err != nil {
+			return err
+		}
+
+		finishReason := choice.FinishReason
+		if err := writeChunk([]models.OpenAIStreamingChoice{{Index: choice.Index, FinishReason: &finishReason}}, nil); err != nil {
+			return err
+		}
+	}
+
+	if includeUsage {
+		if err := writeChunk([]models.OpenAIStreamingChoice{}, &completion.Usage); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write([]byte("data: [DONE]\n\n")); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// errStreamingUnsupported is returned when a stream cannot be flushed
+var errStreamingUnsupported = errors.New("streaming not supported by the response writer")
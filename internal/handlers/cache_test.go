@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/cache"
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// useTestCache enables an in-memory response cache for the test
+func useTestCache(t *testing.T) {
+	t.Helper()
+	if err := cache.Init(cache.Settings{Store: "memory", TTL: time.Hour, MaxEntries: 100}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Init(cache.Settings{}) })
+}
+
+// readRecording returns a recorded stream
+func readRecording(t *testing.T, recording string) string {
+	t.Helper()
+	stream, err := os.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(stream)
+}
+
+// streamServer answers every request with a stream and counts the calls
+func streamServer(t *testing.T, stream string) (*httptest.Server, *int) {
+	t.Helper()
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, stream)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func sendMessage(t *testing.T, cfg config.Config, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HandleMessages(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)), cfg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+func TestStreamedResponseIsCached(t *testing.T) {
+	useTestDB(t)
+	useTestCache(t)
+	upstream, calls := streamServer(t, readRecording(t, "testdata/streams/text.openai.sse"))
+	cfg := config.Config{
+		Providers:       []config.Provider{{Name: "openai", BaseURL: upstream.URL, APIStyle: "openai"}},
+		DefaultProvider: "openai",
+	}
+
+	request := `{"model":"gpt-4o-mini","max_tokens":100,"temperature":0,"messages":[{"role":"user","content":"hi"}]`
+	sendMessage(t, cfg, request+`,"stream":true}`)
+
+	rec := sendMessage(t, cfg, request+`}`)
+	if *calls != 1 || rec.Header().Get(cache.Header) != "hit" {
+		t.Fatalf("upstream called %d times, cache %q, want a hit after the stream", *calls, rec.Header().Get(cache.Header))
+	}
+	var message models.AnthropicResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Content) != 1 || message.Content[0].Text != "Hello! How can I help you today?" || message.StopReason != "end_turn" {
+		t.Errorf("cached message %s", rec.Body.String())
+	}
+
+	// The replayed stream starts like a live one
+	rec = sendMessage(t, cfg, request+`,"stream":true}`)
+	checkEventOrder(t, rec.Body.Bytes())
+	start := readEvents(t, rec.Body.Bytes())[0].data["message"].(map[string]interface{})
+	for _, field := range []string{"stop_reason", "stop_sequence"} {
+		if value, ok := start[field]; !ok || value != nil {
+			t.Errorf("message_start has %s %v, want null", field, value)
+		}
+	}
+}
+
+func TestPassthroughCacheKeyUsesRawBody(t *testing.T) {
+	useTestDB(t)
+	useTestCache(t)
+	upstream, calls := streamServer(t, readRecording(t, "testdata/streams/recorded/tool_use.sse"))
+	cfg := config.Config{
+		Providers:       []config.Provider{{Name: "anthropic", BaseURL: upstream.URL, APIStyle: "anthropic"}},
+		DefaultProvider: "anthropic",
+	}
+
+	request := `{"model":"claude-3-haiku-20240307","max_tokens":100,"temperature":0,"messages":[{"role":"user","content":"weather?"}]`
+	sendMessage(t, cfg, request+`,"stream":true}`)
+
+	rec := sendMessage(t, cfg, request+`}`)
+	if *calls != 1 || rec.Header().Get(cache.Header) != "hit" {
+		t.Fatalf("upstream called %d times, cache %q, want a hit after the stream", *calls, rec.Header().Get(cache.Header))
+	}
+	var message models.AnthropicResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Content) != 2 || message.StopReason != "tool_use" ||
+		string(message.Content[1].Input) != `{"location":"San Francisco, CA","unit":"fahrenheit"}` {
+		t.Errorf("cached message %s", rec.Body.String())
+	}
+
+	// Fields the OpenAI format has no room for still tell requests apart
+	rec = sendMessage(t, cfg, request+`,"thinking":{"type":"enabled","budget_tokens":1024}}`)
+	if *calls != 2 || rec.Header().Get(cache.Header) != "miss" {
+		t.Errorf("request with thinking: upstream called %d times, cache %q, want a miss", *calls, rec.Header().Get(cache.Header))
+	}
+}
+
+func TestStreamedCompletionIsCached(t *testing.T) {
+	useTestDB(t)
+	useTestCache(t)
+	upstream, calls := streamServer(t, readRecording(t, "testdata/streams/tool_use.openai.sse"))
+	cfg := config.Config{
+		Providers:       []config.Provider{{Name: "openai", BaseURL: upstream.URL, APIStyle: "openai"}},
+		DefaultProvider: "openai",
+	}
+
+	request := `{"model":"gpt-4o-mini","temperature":0,"messages":[{"role":"user","content":"weather?"}]`
+	for _, body := range []string{request + `,"stream":true}`, request + `}`} {
+		rec := httptest.NewRecorder()
+		HandleChatCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)), cfg)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+		if *calls != 1 {
+			t.Fatalf("upstream called %d times, want the second request served from the cache", *calls)
+		}
+
+		if !strings.Contains(body, "stream") {
+			var completion models.OpenAIResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &completion); err != nil {
+				t.Fatal(err)
+			}
+			choice := completion.Choices[0]
+			if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 ||
+				choice.Message.ToolCalls[0].Function.Arguments != `{"location": "San Francisco, CA"}` {
+				t.Errorf("cached completion %s", rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestIncompleteStreamIsNotCached(t *testing.T) {
+	openaiText := readRecording(t, "testdata/streams/text.openai.sse")
+	openaiPartial := openaiText[:strings.Index(openaiText, `{"id":"chatcmpl-1","object":"chat.completion.chunk","created":1718000000,"model":"gpt-4o-mini","choices":[{"index":0,"delta":{},`)-len("data: ")]
+	anthropicText := readRecording(t, "testdata/streams/recorded/text.sse")
+	anthropicPartial := anthropicText[:strings.Index(anthropicText, "event: content_block_stop")]
+
+	tests := []struct {
+		name     string
+		apiStyle string
+		path     string
+		stream   string
+		status   int // logged for the request
+	}{
+		{"OpenAI error chunk", "openai", "/v1/chat/completions", openaiPartial + `data: {"error":{"message":"boom","type":"server_error"}}` + "\n\n", http.StatusInternalServerError},
+		{"OpenAI truncated", "openai", "/v1/chat/completions", openaiPartial, http.StatusBadGateway},
+		{"OpenAI translated truncated", "openai", "/v1/messages", openaiPartial, http.StatusBadGateway},
+		{"Anthropic truncated", "anthropic", "/v1/messages", anthropicPartial, http.StatusBadGateway},
+		{"Anthropic translated truncated", "anthropic", "/v1/chat/completions", anthropicPartial, http.StatusBadGateway},
+	}
+	for _, tc := range tests {
+		useTestDB(t)
+		useTestCache(t)
+		upstream, calls := streamServer(t, tc.stream)
+		cfg := config.Config{
+			Providers:       []config.Provider{{Name: tc.apiStyle, BaseURL: upstream.URL, APIStyle: tc.apiStyle}},
+			DefaultProvider: tc.apiStyle,
+		}
+
+		body := `{"model":"m","max_tokens":100,"temperature":0,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body))
+			if tc.path == "/v1/messages" {
+				HandleMessages(rec, r, cfg)
+			} else {
+				HandleChatCompletions(rec, r, cfg)
+			}
+			if rec.Header().Get(cache.Header) != "miss" {
+				t.Errorf("%s: request %d served from the cache: %s", tc.name, i+1, rec.Body.String())
+			}
+			// The client learns that the stream failed in its own format
+			errorFrame := `data: {"error":`
+			if tc.path == "/v1/messages" {
+				errorFrame = "event: error\n"
+			}
+			if !strings.Contains(rec.Body.String(), errorFrame) {
+				t.Errorf("%s: stream ends without an error: %s", tc.name, rec.Body.String())
+			}
+		}
+		if *calls != 2 {
+			t.Errorf("%s: upstream called %d times, want 2", tc.name, *calls)
+		}
+
+		var requestLog models.RequestLog
+		if err := db.DB.Last(&requestLog).Error; err != nil {
+			t.Fatal(err)
+		}
+		if requestLog.ResponseStatus != tc.status {
+			t.Errorf("%s: logged status %d, want %d", tc.name, requestLog.ResponseStatus, tc.status)
+		}
+	}
+}
+
+func TestHasStopReason(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"type":"message","content":[],"stop_reason":"end_turn"}`, true},
+		{`{"type":"message","content":[],"stop_reason":""}`, false},
+		{`{"type":"message","content":[],"stop_reason":null}`, false},
+		{`{"object":"chat.completion","choices":[{"index":0,"finish_reason":"stop"}]}`, true},
+		{`{"object":"chat.completion","choices":[{"index":0,"finish_reason":"stop"},{"index":1,"finish_reason":""}]}`, false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := hasStopReason(tc.body); got != tc.want {
+			t.Errorf("hasStopReason(%s) = %v, want %v", tc.body, got, tc.want)
+		}
+	}
+}
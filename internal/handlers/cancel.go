@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/token_counter"
+)
+
+// clientGone reports whether the client has disconnected. Upstream requests
+// are made with the client's context, so an upstream read is aborted as soon
+// as this happens and no more tokens are generated for nobody.
+func clientGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// responseClientGone is clientGone for the client of an upstream response
+func responseClientGone(resp *http.Response) bool {
+	return resp.Request != nil && clientGone(resp.Request.Context())
+}
+
+// logClientCancelled records a request whose client disconnected before the
+// response was complete, with the output and usage up to that point
+func logClientCancelled(requestLog *models.RequestLog, startTime time.Time, output string, usageJSON string) {
+	processingTime := time.Since(startTime).Milliseconds()
+	log.Printf("Client cancelled the request after %d ms", processingTime)
+	if requestLog == nil {
+		return
+	}
+	db.UpdateResponseLog(requestLog, models.StatusClientCancelled, nil, output, processingTime, usageJSON)
+}
+
+// estimatePartialOutput counts the output of an Anthropic stream that ended
+// before message_delta reported the final output tokens
+func estimatePartialOutput(usage *models.AnthropicUsage, output string, model string) {
+	if output == "" {
+		return
+	}
+	tokens, err := token_counter.CountTokensInResponse(output, model)
+	if err != nil {
+		log.Printf("Error counting tokens in partial response: %v", err)
+		return
+	}
+	if tokens > usage.OutputTokens {
+		usage.OutputTokens = tokens
+	}
+}
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/converter"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/token_counter"
+)
+
+// HandleChatCompletions handles the OpenAI-compatible /v1/chat/completions
+// endpoint. Requests are already in the upstream format, so they are forwarded
+// unchanged and only inspected for logging and cost tracking.
+func HandleChatCompletions(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	virtualKey, err := authenticate(r, config)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+		return
+	}
+	if err := checkBudgets(w, virtualKey); err != nil {
+		writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota", err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Error reading request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var openaiReq models.OpenAIRequest
+	if err := json.Unmarshal(body, &openaiReq); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Error parsing request JSON")
+		return
+	}
+
+	reservation, rateLimit := reserveRateLimit(r, config, virtualKey, openaiReq.Model, body, "openai")
+	if rateLimit != nil && !rateLimit.Allowed {
+		setOpenAIRateLimitHeaders(w, rateLimit)
+		writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_exceeded", rateLimit.Reason)
+		return
+	}
+	// Correct the reserved tokens with the actual usage once the response
+	// has been relayed and logged, or when the request ends early
+	var requestLog *models.RequestLog
+	defer func() { completeRateLimit(reservation, requestLog) }()
+
+	// Extract additional parameters for logging
+	additionalParams := map[string]interface{}{
+		"temperature":       openaiReq.Temperature,
+		"top_p":             openaiReq.TopP,
+		"n":                 openaiReq.N,
+		"stop":              openaiReq.Stop,
+		"presence_penalty":  openaiReq.PresencePenalty,
+		"frequency_penalty": openaiReq.FrequencyPenalty,
+	}
+
+	additionalParamsJSON, err := json.Marshal(additionalParams)
+	if err != nil {
+		log.Printf("Error marshaling additional params: %v", err)
+		additionalParamsJSON = []byte("{}")
+	}
+
+	systemPrompt := converter.OpenAISystemPrompt(openaiReq.Messages)
+
+	// Log the request to the database
+	requestLog, err = db.LogRequest(r, "openai", string(body), openaiReq.Model, openaiReq.Stream, string(additionalParamsJSON), systemPrompt)
+	if err != nil {
+		log.Printf("Error logging request: %v", err)
+		// Continue processing even if logging fails
+	}
+	if requestLog != nil && virtualKey != nil {
+		requestLog.KeyID = virtualKey.ID
+	}
+
+	targets, err := config.Resolve(openaiReq.Model)
+	if err != nil {
+		responseBody := writeOpenAIError(w, http.StatusNotFound, "not_found_error", err.Error())
+		if requestLog != nil {
+			db.UpdateResponseLog(requestLog, http.StatusNotFound, nil, responseBody, 0, "")
+		}
+		return
+	}
+	log.Printf("Routing model %s to %d target(s), first %s as %s", openaiReq.Model, len(targets), targets[0].Provider.Name, targets[0].Model)
+
+	// The Anthropic request is converted once and reused by every
+	// Anthropic-style target in the fallback chain
+	var anthropicReq models.AnthropicRequest
+	if hasAPIStyle(targets, "anthropic") {
+		anthropicReq, err = converter.ConvertToAnthropicRequest(openaiReq)
+		if err != nil {
+			responseBody := writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			if requestLog != nil {
+				db.UpdateResponseLog(requestLog, http.StatusBadRequest, nil, responseBody, 0, "")
+			}
+			return
+		}
+	}
+
+	// Deterministic requests may be answered from the response cache.
+	// OpenAI-style targets receive the raw body, so the cache key is taken
+	// from it when one is in the chain, as the parsed request lacks fields
+	// such as response_format that change the answer.
+	var cacheKey string
+	if hasAPIStyle(targets, "openai") {
+		cacheKey = rawResponseCacheKey(r, "openai", openaiReq.Temperature, body)
+	} else {
+		cacheKey = responseCacheKey(r, "openai", openaiReq)
+	}
+	includeUsage := openaiReq.StreamOptions != nil && openaiReq.StreamOptions.IncludeUsage
+	if cacheKey != "" && serveCached(w, cacheKey, requestLog, "openai", openaiReq.Stream, includeUsage) {
+		return
+	}
+
+	startTime := time.Now()
+
+	resp, target, err := sendWithFallback(requestLog, targets, func(i int) (*http.Request, error) {
+		if targets[i].Provider.APIStyle == "anthropic" {
+			upstreamReq := anthropicReq
+			upstreamReq.Model = targets[i].Model
+			reqBody, err := json.Marshal(upstreamReq)
+			if err != nil {
+				return nil, err
+			}
+			return newAnthropicRequest(r, config, targets[i].Provider, reqBody)
+		}
+
+		// Requests to OpenAI-style targets are forwarded unchanged apart from
+		// the routed model name
+		reqBody := body
+		if targets[i].Model != openaiReq.Model {
+			var err error
+			if reqBody, err = replaceModel(body, targets[i].Model); err != nil {
+				return nil, err
+			}
+		}
+		return newChatRequest(r, targets[i].Provider, reqBody)
+	})
+	if err != nil && clientGone(r.Context()) {
+		logClientCancelled(requestLog, startTime, "", "")
+		return
+	}
+	if err != nil {
+		status, errType := openaiGatewayError(err)
+		responseBody := writeOpenAIError(w, status, errType, err.Error())
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, status, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if target.Provider.APIStyle == "anthropic" {
+		relayAnthropicAsOpenAI(w, resp, openaiReq, requestLog, startTime)
+	} else {
+		relayChatResponse(w, resp, openaiReq, requestLog, startTime)
+	}
+	storeCachedResponse(cacheKey, requestLog, openaiReq.Stream)
+}
+
+// newChatRequest builds a request that forwards an OpenAI request body to an
+// OpenAI-style provider
+func newChatRequest(r *http.Request, provider config.Provider, body []byte) (*http.Request, error) {
+	// BaseURL doesn't have "/" in the end as it's trimmed in config.go
+	url := provider.BaseURL + "/chat/completions"
+	log.Printf("Forwarding OpenAI request to %s: %s", url, string(body))
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	setOpenAIAuth(req, r, provider)
+
+	return req, nil
+}
+
+// relayChatResponse writes the response of an OpenAI-style provider to the
+// client unchanged and logs it
+func relayChatResponse(w http.ResponseWriter, resp *http.Response, openaiReq models.OpenAIRequest, requestLog *models.RequestLog, startTime time.Time) {
+	log.Printf("Response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
+
+	for key, values := range resp.Header {
+		// Streams are re-framed line by line, so the length may change
+		if key == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if openaiReq.Stream && resp.StatusCode == http.StatusOK {
+		passthroughStream(w, resp, requestLog, openaiReq, startTime)
+		return
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		if responseClientGone(resp) {
+			logClientCancelled(requestLog, startTime, string(responseBody), "")
+			return
+		}
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, "Error reading response body: "+err.Error(), processingTime, "")
+		}
+		return
+	}
+
+	if _, err := w.Write(responseBody); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+
+	if requestLog == nil {
+		return
+	}
+
+	processingTime := time.Since(startTime).Milliseconds()
+
+	// Extract usage information if available
+	var usageJSON string
+	var openaiResp models.OpenAIResponse
+	if resp.StatusCode == http.StatusOK && json.Unmarshal(responseBody, &openaiResp) == nil && openaiResp.Usage.TotalTokens > 0 {
+		usageData, err := json.Marshal(openaiResp.Usage)
+		if err != nil {
+			log.Printf("Error encoding usage information: %v", err)
+		} else {
+			usageJSON = string(usageData)
+			requestLog.UsageSource = "reported"
+		}
+	}
+
+	db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(responseBody), processingTime, usageJSON)
+}
+
+// passthroughStream copies an OpenAI SSE stream to the client unchanged while
+// collecting the output and usage for the request log
+func passthroughStream(w http.ResponseWriter, resp *http.Response, requestLog *models.RequestLog, openaiReq models.OpenAIRequest, startTime time.Time) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming not supported by the response writer")
+		return
+	}
+
+	var output strings.Builder
+	counter := token_counter.NewOutputCounter(openaiReq.Model)
+	var usage *models.OpenAIUsage
+	writeFailed := false
+
+	// failure is the error chunk the upstream ended the stream with, if any
+	var failure string
+	var failureStatus int
+	complete := false // [DONE] or a finish_reason was received
+	completion := newCompletionAssembler()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			log.Printf("Error writing to response: %v", err)
+			writeFailed = true
+			break
+		}
+		if line == "" {
+			flusher.Flush()
+			continue
+		}
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			complete = true
+			continue
+		}
+
+		var chunk models.OpenAIStreamingChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Printf("Error parsing OpenAI chunk: %v", err)
+			continue
+		}
+		if len(chunk.Error) > 0 {
+			// The client has the error chunk already, only the log needs it
+			log.Printf("Upstream error in stream: %s", data)
+			failure = data
+			failureStatus, _, _ = translateOpenAIError(http.StatusOK, []byte(data))
+		}
+		completion.add(chunk)
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				complete = true
+			}
+			output.WriteString(choice.Delta.Content)
+			counter.Add(choice.Delta.Content)
+			for _, toolCall := range choice.Delta.ToolCalls {
+				output.WriteString(toolCall.Function.Name)
+				output.WriteString(toolCall.Function.Arguments)
+				counter.Add(toolCall.Function.Name)
+				counter.Add(toolCall.Function.Arguments)
+			}
+		}
+	}
+	flusher.Flush()
+
+	// A cancelled stream is logged like a complete one, with the output and
+	// usage up to the disconnect
+	cancelled := writeFailed || (scanner.Err() != nil && responseClientGone(resp))
+	if !cancelled {
+		if failure != "" {
+			recordStreamOutcome(resp, failureStatus < 500)
+		} else {
+			recordStreamOutcome(resp, scanner.Err() == nil && complete)
+		}
+	}
+	if err := scanner.Err(); err != nil && !cancelled {
+		log.Printf("Error reading from response: %v", err)
+		responseBody := writeOpenAIStreamError(w, flusher, "server_error", "Error reading from upstream: "+err.Error())
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	if failure != "" {
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, failureStatus, resp.Header, failure, processingTime, "")
+		}
+		return
+	}
+
+	if !cancelled && !complete {
+		log.Printf("Upstream stream ended without [DONE] or a finish_reason")
+		responseBody := writeOpenAIStreamError(w, flusher, "server_error", incompleteStreamMessage)
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, responseBody, processingTime, "")
+		}
+		return
+	}
+
+	if !cancelled {
+		log.Printf("Completed streaming response")
+	}
+	if requestLog == nil {
+		return
+	}
+
+	processingTime := time.Since(startTime).Milliseconds()
+
+	// Prefer the usage reported by the upstream, which is only sent when the
+	// client asked for it with stream_options.include_usage
+	var inputTokens, outputTokens int
+	if usage != nil {
+		inputTokens, outputTokens = usage.PromptTokens, usage.CompletionTokens
+		requestLog.UsageSource = "reported"
+	} else {
+		requestLog.UsageSource = "estimated"
+		var err error
+		inputTokens, err = token_counter.CountTokensInRequest(requestLog.RequestBody, "openai")
+		if err != nil {
+			log.Printf("Error counting tokens in request: %v", err)
+		}
+		if output.Len() > 0 {
+			outputTokens, err = counter.Total()
+			if err != nil {
+				log.Printf("Error counting tokens in response: %v", err)
+			}
+		}
+	}
+
+	usageJSON, err := token_counter.CreateUsageJSON(inputTokens, outputTokens, "openai")
+	if err != nil {
+		log.Printf("Error creating usage JSON: %v", err)
+	}
+
+	if cancelled {
+		logClientCancelled(requestLog, startTime, output.String(), usageJSON)
+		return
+	}
+	completion.setUsage(models.OpenAIUsage{PromptTokens: inputTokens, CompletionTokens: outputTokens, TotalTokens: inputTokens + outputTokens})
+	requestLog.StreamedResponse = completion.response()
+	db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, output.String(), processingTime, usageJSON)
+}
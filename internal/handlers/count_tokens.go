@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/token_counter"
+)
+
+// countTokensResponse is the response of /v1/messages/count_tokens. Tokenizer
+// is not part of the Anthropic API; it names the encoding the count was made
+// with, since counts for models without a public tokenizer are estimates.
+type countTokensResponse struct {
+	InputTokens int    `json:"input_tokens"`
+	Tokenizer   string `json:"tokenizer"`
+}
+
+// HandleCountTokens handles the /v1/messages/count_tokens endpoint. Tokens
+// are counted locally, so no upstream is called and nothing is logged.
+func HandleCountTokens(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	if _, err := authenticate(r, config); err != nil {
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error reading request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var anthropicReq models.AnthropicRequest
+	if err := json.Unmarshal(body, &anthropicReq); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error parsing request JSON: "+err.Error())
+		return
+	}
+	if anthropicReq.Model == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "model: Field required")
+		return
+	}
+
+	tokens, err := token_counter.CountTokensInRequest(string(body), "anthropic")
+	if err != nil {
+		log.Printf("Error counting tokens: %v", err)
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error counting tokens: "+err.Error())
+		return
+	}
+
+	response := countTokensResponse{
+		InputTokens: tokens,
+		Tokenizer:   token_counter.EncodingForModel(anthropicReq.Model),
+	}
+	log.Printf("Counted %d input tokens for %s with %s", response.InputTokens, anthropicReq.Model, response.Tokenizer)
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/breaker"
+)
+
+// statusOverloaded is the status the Anthropic API uses for overloaded_error
+const statusOverloaded = 529
+
+// anthropicError is the error body returned by the Anthropic API
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeAnthropicError writes an error response in the Anthropic format, e.g.
+// {"type":"error","error":{"type":"invalid_request_error","message":"..."}}
+func writeAnthropicError(w http.ResponseWriter, status int, errorType string, message string) string {
+	body := anthropicError{Type: "error"}
+	body.Error.Type = errorType
+	body.Error.Message = message
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshaling error response: %v", err)
+		http.Error(w, message, status)
+		return message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(bodyJSON); err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+	return string(bodyJSON)
+}
+
+// openaiError is the error body returned by the OpenAI API
+type openaiError struct {
+	Error struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Code    *string `json:"code"`
+	} `json:"error"`
+}
+
+// writeOpenAIError writes an error response in the OpenAI format, e.g.
+// {"error":{"message":"...","type":"invalid_request_error","code":null}}
+func writeOpenAIError(w http.ResponseWriter, status int, errorType string, message string) string {
+	body := openaiError{}
+	body.Error.Type = errorType
+	body.Error.Message = message
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshaling error response: %v", err)
+		http.Error(w, message, status)
+		return message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(bodyJSON); err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+	return string(bodyJSON)
+}
+
+// anthropicErrorType returns the Anthropic error type for an HTTP status
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusPaymentRequired:
+		return "billing_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusGatewayTimeout:
+		return "timeout_error"
+	case statusOverloaded:
+		return "overloaded_error"
+	}
+	if status >= 500 {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// anthropicErrorStatus returns the HTTP status for an Anthropic error type,
+// for errors that arrive in a stream without a status of their own
+func anthropicErrorStatus(errorType string) int {
+	switch errorType {
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	case "authentication_error":
+		return http.StatusUnauthorized
+	case "billing_error":
+		return http.StatusPaymentRequired
+	case "permission_error":
+		return http.StatusForbidden
+	case "not_found_error":
+		return http.StatusNotFound
+	case "request_too_large":
+		return http.StatusRequestEntityTooLarge
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "timeout_error":
+		return http.StatusGatewayTimeout
+	case "overloaded_error":
+		return statusOverloaded
+	}
+	return http.StatusInternalServerError
+}
+
+// parseAnthropicStreamError reads the data of an Anthropic error event and
+// returns its status, error type and message
+func parseAnthropicStreamError(data string) (int, string, string) {
+	var event anthropicError
+	if err := json.Unmarshal([]byte(data), &event); err != nil || event.Error.Type == "" {
+		return http.StatusInternalServerError, "api_error", data
+	}
+	return anthropicErrorStatus(event.Error.Type), event.Error.Type, event.Error.Message
+}
+
+// anthropicStatus is an Anthropic error type with its HTTP status
+type anthropicStatus struct {
+	status    int
+	errorType string
+}
+
+// openaiErrorCodes maps the code field of OpenAI errors, which is the most
+// specific hint of what went wrong
+var openaiErrorCodes = map[string]anthropicStatus{
+	"context_length_exceeded":              {http.StatusBadRequest, "invalid_request_error"},
+	"string_above_max_length":              {http.StatusBadRequest, "invalid_request_error"},
+	"content_filter":                       {http.StatusBadRequest, "invalid_request_error"},
+	"content_policy_violation":             {http.StatusBadRequest, "invalid_request_error"},
+	"invalid_api_key":                      {http.StatusUnauthorized, "authentication_error"},
+	"invalid_organization":                 {http.StatusUnauthorized, "authentication_error"},
+	"insufficient_quota":                   {http.StatusPaymentRequired, "billing_error"},
+	"billing_hard_limit_reached":           {http.StatusPaymentRequired, "billing_error"},
+	"unsupported_country_region_territory": {http.StatusForbidden, "permission_error"},
+	"model_not_found":                      {http.StatusNotFound, "not_found_error"},
+	"rate_limit_exceeded":                  {http.StatusTooManyRequests, "rate_limit_error"},
+	"server_error":                         {http.StatusInternalServerError, "api_error"},
+	"engine_overloaded":                    {statusOverloaded, "overloaded_error"},
+}
+
+// openaiErrorTypes maps the type field of OpenAI errors, used when the code
+// is missing or unknown
+var openaiErrorTypes = map[string]anthropicStatus{
+	"invalid_request_error": {http.StatusBadRequest, "invalid_request_error"},
+	"authentication_error":  {http.StatusUnauthorized, "authentication_error"},
+	"insufficient_quota":    {http.StatusPaymentRequired, "billing_error"},
+	"permission_error":      {http.StatusForbidden, "permission_error"},
+	"not_found_error":       {http.StatusNotFound, "not_found_error"},
+	"rate_limit_error":      {http.StatusTooManyRequests, "rate_limit_error"},
+	"requests":              {http.StatusTooManyRequests, "rate_limit_error"},
+	"tokens":                {http.StatusTooManyRequests, "rate_limit_error"},
+	"server_error":          {http.StatusInternalServerError, "api_error"},
+	"overloaded_error":      {statusOverloaded, "overloaded_error"},
+}
+
+// translateOpenAIError maps an error body from an OpenAI-style upstream to
+// an Anthropic status, error type and message. It understands the OpenAI
+// error object as well as the variants used by routers, where code may be
+// the HTTP status and error may be a plain string. Unknown bodies are mapped
+// by status with the body as the message. Pass a 200 status for errors
+// received in a stream.
+func translateOpenAIError(status int, body []byte) (int, string, string) {
+	// Errors sent in the middle of a stream arrive with a 200 status
+	streamed := status < 400
+	if streamed {
+		status = http.StatusInternalServerError
+	}
+	// A 503 means the upstream is overloaded, which Anthropic reports as 529
+	if status == http.StatusServiceUnavailable {
+		status = statusOverloaded
+	}
+	result := anthropicStatus{status, anthropicErrorType(status)}
+	message := strings.TrimSpace(string(body))
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	var upstream struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &upstream); err != nil || len(upstream.Error) == 0 {
+		return result.status, result.errorType, message
+	}
+
+	var text string
+	if err := json.Unmarshal(upstream.Error, &text); err == nil {
+		return result.status, result.errorType, text
+	}
+
+	var errorObject struct {
+		Message string      `json:"message"`
+		Type    string      `json:"type"`
+		Code    interface{} `json:"code"`
+	}
+	if err := json.Unmarshal(upstream.Error, &errorObject); err != nil {
+		return result.status, result.errorType, message
+	}
+	if errorObject.Message != "" {
+		message = errorObject.Message
+	}
+
+	switch code := errorObject.Code.(type) {
+	case string:
+		if mapped, ok := openaiErrorCodes[code]; ok {
+			return mapped.status, mapped.errorType, message
+		}
+	case float64:
+		// Routers report the status of the failed provider as the code,
+		// which is the only status there is for errors in a stream
+		if codeStatus := int(code); codeStatus >= 400 && codeStatus < 600 && streamed {
+			if codeStatus == http.StatusServiceUnavailable {
+				codeStatus = statusOverloaded
+			}
+			return codeStatus, anthropicErrorType(codeStatus), message
+		}
+	}
+	if mapped, ok := openaiErrorTypes[errorObject.Type]; ok {
+		// Keep more specific client error statuses, e.g. 413 for
+		// invalid_request_error
+		if mapped.status == http.StatusBadRequest && status >= 400 && status < 500 {
+			return status, anthropicErrorType(status), message
+		}
+		return mapped.status, mapped.errorType, message
+	}
+	return result.status, result.errorType, message
+}
+
+// writeTranslatedError writes an error from an OpenAI-style upstream to an
+// Anthropic client
+func writeTranslatedError(w http.ResponseWriter, status int, body []byte) string {
+	status, errorType, message := translateOpenAIError(status, body)
+	return writeAnthropicError(w, status, errorType, message)
+}
+
+// gatewayError returns the status and Anthropic error type for a failure to
+// get a response from any upstream
+func gatewayError(err error) (int, string) {
+	if errors.Is(err, breaker.ErrOpen) {
+		return statusOverloaded, "overloaded_error"
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, "timeout_error"
+	}
+	return http.StatusBadGateway, "api_error"
+}
+
+// openaiGatewayError is gatewayError for OpenAI clients, which know an
+// overloaded upstream as 503 and report failures as server_error
+func openaiGatewayError(err error) (int, string) {
+	status, errorType := gatewayError(err)
+	if errorType == "overloaded_error" {
+		return http.StatusServiceUnavailable, errorType
+	}
+	return status, "server_error"
+}
+
+// writeAnthropicStreamError writes an error event to an Anthropic stream
+// whose headers have already been sent, as the Anthropic API does when a
+// stream fails part way through
+func writeAnthropicStreamError(w http.ResponseWriter, flusher http.Flusher, errorType string, message string) string {
+	body := anthropicError{Type: "error"}
+	body.Error.Type = errorType
+	body.Error.Message = message
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshaling error event: %v", err)
+		return message
+	}
+
+	if _, err := w.Write([]byte("event: error\ndata: " + string(bodyJSON) + "\n\n")); err != nil {
+		log.Printf("Error writing error event: %v", err)
+	}
+	flusher.Flush()
+	return string(bodyJSON)
+}
+
+// writeOpenAIStreamError writes an error chunk to an OpenAI stream whose
+// headers have already been sent, followed by [DONE] so that clients stop
+// reading, as OpenAI-style upstreams do when a stream fails part way through
+func writeOpenAIStreamError(w http.ResponseWriter, flusher http.Flusher, errorType string, message string) string {
+	body := openaiError{}
+	body.Error.Type = errorType
+	body.Error.Message = message
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshaling error chunk: %v", err)
+		return message
+	}
+
+	if _, err := w.Write([]byte("data: " + string(bodyJSON) + "\n\ndata: [DONE]\n\n")); err != nil {
+		log.Printf("Error writing error chunk: %v", err)
+	}
+	flusher.Flush()
+	return string(bodyJSON)
+}
+
+// copyRetryAfter passes the retry hints of an upstream error on to the
+// client, so SDKs back off as long as the upstream asked
+func copyRetryAfter(w http.ResponseWriter, resp *http.Response) {
+	for _, header := range []string{"retry-after", "retry-after-ms"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/breaker"
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/retry"
+)
+
+// maxAttemptErrorSize limits how much of a failed upstream response is kept
+// on the attempt record
+const maxAttemptErrorSize = 4096
+
+// circuitKey is the context key under which sendWithFallback stores the
+// breaker of the target a request was sent to
+type circuitKey struct{}
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*http.Client)
+)
+
+// clientFor returns the HTTP client for a provider, which applies the
+// provider's response header timeout. Clients are shared so connections to
+// the provider are reused.
+func clientFor(provider config.Provider) *http.Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if client, ok := clients[provider.Name]; ok {
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(provider.TimeoutSeconds) * time.Second
+	client := &http.Client{Transport: transport}
+	clients[provider.Name] = client
+	return client
+}
+
+// shouldFallback reports whether an upstream status is worth retrying on the
+// next target of a fallback chain
+func shouldFallback(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// sendWithFallback sends the request built for each target in turn, with the
+// provider's retry policy, until one answers with a response that should not
+// fail over. Targets whose circuit breaker is open are skipped, and
+// breaker.ErrOpen is returned when no target could be tried. Failed responses are
+// drained and closed, so nothing reaches the client before a target answers.
+// The response of the last target is returned whatever its status. Every
+// call is recorded as a RequestAttempt. build receives the index of the
+// target in targets.
+func sendWithFallback(requestLog *models.RequestLog, targets []config.Target, build func(i int) (*http.Request, error)) (*http.Response, config.Target, error) {
+	var lastErr error
+	for i, target := range targets {
+		attempt := models.RequestAttempt{
+			Attempt:   i + 1,
+			Provider:  target.Provider.Name,
+			ModelName: target.Model,
+		}
+
+		circuit := breaker.For(target.Provider.Name, target.Model, target.Provider.BreakerSettings())
+		if !circuit.Allow() {
+			log.Printf("Circuit breaker for %s (%s) is open, skipping", target.Provider.Name, target.Model)
+			attempt.Error = breaker.ErrOpen.Error()
+			recordAttempt(requestLog, &attempt)
+			lastErr = breaker.ErrOpen
+			continue
+		}
+
+		req, err := build(i)
+		if err != nil {
+			return nil, target, err
+		}
+		req = req.WithContext(context.WithValue(req.Context(), circuitKey{}, circuit))
+
+		startTime := time.Now()
+		resp, stats, err := retry.Do(clientFor(target.Provider), req, target.Provider.RetryPolicy())
+		attempt.Latency = time.Since(startTime).Milliseconds()
+		attempt.Retries = stats.Retries
+		if requestLog != nil {
+			requestLog.RetryCount += stats.Retries
+			requestLog.BackoffMs += stats.Backoff.Milliseconds()
+		}
+
+		// A client that went away has no use for a fallback
+		if req.Context().Err() != nil {
+			attempt.Error = req.Context().Err().Error()
+			recordAttempt(requestLog, &attempt)
+			return nil, target, req.Context().Err()
+		}
+
+		// Rate limits say nothing about the health of the upstream. Whether
+		// a stream succeeded is only known once it has been read, so the
+		// stream handlers record it with recordStreamOutcome.
+		if err != nil || !isStream(resp) {
+			circuit.Record(err == nil && resp.StatusCode < 500)
+		}
+
+		if err != nil {
+			log.Printf("Attempt %d to %s (%s) failed: %v", attempt.Attempt, target.Provider.Name, target.Model, err)
+			attempt.Error = err.Error()
+			recordAttempt(requestLog, &attempt)
+			lastErr = err
+			continue
+		}
+
+		attempt.Status = resp.StatusCode
+		if i < len(targets)-1 && shouldFallback(resp.StatusCode) {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxAttemptErrorSize))
+			resp.Body.Close()
+			log.Printf("Attempt %d to %s (%s) failed with status %d, falling back", attempt.Attempt, target.Provider.Name, target.Model, resp.StatusCode)
+			attempt.Error = string(body)
+			recordAttempt(requestLog, &attempt)
+			continue
+		}
+
+		attempt.Final = true
+		recordAttempt(requestLog, &attempt)
+		return resp, target, nil
+	}
+
+	return nil, config.Target{}, lastErr
+}
+
+// isStream reports whether a response is a successful SSE stream
+func isStream(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// recordStreamOutcome reports how a stream from sendWithFallback ended to
+// the circuit breaker of its target. Streams the client abandoned say
+// nothing about the upstream and are not recorded.
+func recordStreamOutcome(resp *http.Response, success bool) {
+	if resp.Request == nil || !isStream(resp) || responseClientGone(resp) {
+		return
+	}
+	if circuit, ok := resp.Request.Context().Value(circuitKey{}).(*breaker.Breaker); ok {
+		circuit.Record(success)
+	}
+}
+
+// recordAttempt stores an attempt. The request log keeps the provider and
+// model of the latest attempt, which is the one that answered on success.
+func recordAttempt(requestLog *models.RequestLog, attempt *models.RequestAttempt) {
+	if requestLog == nil {
+		return
+	}
+
+	requestLog.Provider = attempt.Provider
+	requestLog.UpstreamModel = attempt.ModelName
+	requestLog.AttemptCount = attempt.Attempt
+	attempt.RequestLogID = requestLog.ID
+	if err := db.LogAttempt(attempt); err != nil {
+		log.Printf("Error logging attempt: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vitali/ai-gateway/internal/breaker"
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB points the global database at a fresh database for the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	testDB, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB.Logger = logger.Default.LogMode(logger.Silent)
+
+	previous := db.DB
+	db.DB = testDB
+	t.Cleanup(func() { db.DB = previous })
+}
+
+func TestFallbackIsPricedAtAnsweringModel(t *testing.T) {
+	useTestDB(t)
+	db.DB.Create(&models.ModelPrice{ModelName: "claude-x", InputPrice: 1, OutputPrice: 1})
+	db.DB.Create(&models.ModelPrice{ModelName: "backup/gpt-4o", InputPrice: 0.01, OutputPrice: 0.02})
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		http.Error(w, `{"error":{"message":"boom","type":"server_error"}}`, http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":100,"completion_tokens":10,"total_tokens":110}}`)
+	}))
+	defer backup.Close()
+
+	cfg := config.Config{
+		StreamUsage: true,
+		Providers: []config.Provider{
+			{Name: "primary", BaseURL: primary.URL, APIStyle: "openai"},
+			{Name: "backup", BaseURL: backup.URL, APIStyle: "openai", ModelPrefix: "backup/"},
+		},
+		Routes: []config.Route{
+			{Match: "claude-*", Provider: "primary", Fallbacks: []config.Fallback{{Provider: "backup", Model: "gpt-4o"}}},
+		},
+		DefaultProvider: "primary",
+	}
+
+	rec := httptest.NewRecorder()
+	body := `{"model":"claude-x","messages":[{"role":"user","content":"hi"}]}`
+	HandleChatCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)), cfg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var requestLog models.RequestLog
+	if err := db.DB.Last(&requestLog).Error; err != nil {
+		t.Fatal(err)
+	}
+	if requestLog.AttemptCount != 2 || requestLog.UpstreamModel != "backup/gpt-4o" {
+		t.Fatalf("got attempt %d with %q, want attempt 2 with backup/gpt-4o", requestLog.AttemptCount, requestLog.UpstreamModel)
+	}
+	want := 100*0.01 + 10*0.02
+	if math.Abs(requestLog.Cost-want) > 1e-9 {
+		t.Errorf("cost %f, want %f from the answering model's price", requestLog.Cost, want)
+	}
+}
+
+func TestStreamOutcomeIsRecorded(t *testing.T) {
+	useTestDB(t)
+
+	tests := []struct {
+		name    string
+		stream  string
+		success bool
+		status  int // logged for the request
+	}{
+		{"complete", `data: {"id":"c","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}` + "\n\ndata: [DONE]\n\n", true, http.StatusOK},
+		{"truncated", `data: {"id":"c","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"hi"}}]}` + "\n\n", false, http.StatusBadGateway},
+		{"error chunk", `data: {"error":{"message":"boom","type":"server_error"}}` + "\n\n", false, http.StatusInternalServerError},
+		{"rate limited", `data: {"error":{"message":"slow down","type":"rate_limit_error"}}` + "\n\n", true, http.StatusTooManyRequests},
+	}
+	for _, tc := range tests {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, tc.stream)
+		}))
+		defer upstream.Close()
+
+		provider := config.Provider{Name: "stream " + tc.name, BaseURL: upstream.URL, APIStyle: "openai"}
+		cfg := config.Config{Providers: []config.Provider{provider}, DefaultProvider: provider.Name}
+
+		rec := httptest.NewRecorder()
+		body := `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		HandleChatCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)), cfg)
+
+		status := breaker.For(provider.Name, "m", provider.BreakerSettings()).Status()
+		if status.Successes+status.Errors != 1 || (status.Successes == 1) != tc.success {
+			t.Errorf("%s: recorded %d successes and %d errors, want success %v", tc.name, status.Successes, status.Errors, tc.success)
+		}
+
+		var requestLog models.RequestLog
+		if err := db.DB.Last(&requestLog).Error; err != nil {
+			t.Fatal(err)
+		}
+		if requestLog.ResponseStatus != tc.status {
+			t.Errorf("%s: logged status %d, want %d", tc.name, requestLog.ResponseStatus, tc.status)
+		}
+	}
+}
+
+func TestOpenAIGatewayError(t *testing.T) {
+	tests := []struct {
+		err       error
+		status    int
+		errorType string
+	}{
+		{breaker.ErrOpen, http.StatusServiceUnavailable, "overloaded_error"},
+		{fmt.Errorf("request failed: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "server_error"},
+		{errors.New("connection refused"), http.StatusBadGateway, "server_error"},
+	}
+	for _, tc := range tests {
+		status, errorType := openaiGatewayError(tc.err)
+		if status != tc.status || errorType != tc.errorType {
+			t.Errorf("%v: got %d %s, want %d %s", tc.err, status, errorType, tc.status, tc.errorType)
+		}
+	}
+}
@@ -12,16 +12,16 @@ import (
 // HandleModels handles the /v1/models endpoint
 func HandleModels(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
 		return
 	}
 
-	// Get all models from the database
+	// Get all models with their current price from the database
 	var modelPrices []models.ModelPrice
-	result := db.DB.Find(&modelPrices)
+	result := db.DB.Where("effective_to IS NULL").Find(&modelPrices)
 	if result.Error != nil {
 		log.Printf("Error fetching models: %v", result.Error)
-		http.Error(w, "Error fetching models", http.StatusInternalServerError)
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Error fetching models")
 		return
 	}
 
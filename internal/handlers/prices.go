@@ -8,6 +8,12 @@ import (
 	"github.com/vitali/ai-gateway/internal/models"
 )
 
+// modelPriceHistory holds the prices a model has had, newest first
+type modelPriceHistory struct {
+	ModelName string
+	Prices    []models.ModelPrice
+}
+
 // HandlePricesPage renders a page with model pricing information
 func HandlePricesPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -15,21 +21,29 @@ func HandlePricesPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all models from the database
-	var modelPrices []models.ModelPrice
-	result := db.DB.Find(&modelPrices)
-	if result.Error != nil {
-		http.Error(w, "Error fetching models: "+result.Error.Error(), http.StatusInternalServerError)
+	// Get all prices from the database, grouped by model with the newest first
+	modelPrices, err := db.GetModelPriceHistory()
+	if err != nil {
+		http.Error(w, "Error fetching models: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	var histories []modelPriceHistory
+	for _, price := range modelPrices {
+		if len(histories) == 0 || histories[len(histories)-1].ModelName != price.ModelName {
+			histories = append(histories, modelPriceHistory{ModelName: price.ModelName})
+		}
+		history := &histories[len(histories)-1]
+		history.Prices = append(history.Prices, price)
+	}
+
 	// Prepare data for template
 	data := struct {
-		Models     []models.ModelPrice
+		Models     []modelPriceHistory
 		TotalCount int
 	}{
-		Models:     modelPrices,
-		TotalCount: len(modelPrices),
+		Models:     histories,
+		TotalCount: len(histories),
 	}
 
 	// Load HTML template from file
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/models"
+	"github.com/vitali/ai-gateway/internal/ratelimit"
+	"github.com/vitali/ai-gateway/internal/token_counter"
+)
+
+// reserveRateLimit counts a request and its estimated input tokens against
+// the configured rate limits. The result is nil when no rule applies.
+func reserveRateLimit(r *http.Request, config config.Config, virtualKey *models.VirtualKey, model string, body []byte, requestType string) (*ratelimit.Reservation, *ratelimit.Result) {
+	if len(config.RateLimits) == 0 {
+		return nil, nil
+	}
+
+	subject := ratelimit.Subject{Model: model}
+	if virtualKey != nil {
+		subject.Key = strconv.FormatUint(uint64(virtualKey.ID), 10)
+	}
+	subject.IP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		subject.IP = host
+	}
+
+	reservation, result := ratelimit.Reserve(config.RateLimits, subject, estimateInputTokens(body, requestType))
+	return reservation, &result
+}
+
+// estimateInputTokens counts the tokens of a request, falling back to about
+// four bytes per token when the tokenizer is unavailable
+func estimateInputTokens(body []byte, requestType string) int {
+	tokens, err := token_counter.CountTokensInRequest(string(body), requestType)
+	if err != nil {
+		log.Printf("Error counting request tokens for rate limiting, estimating from size: %v", err)
+		return len(body) / 4
+	}
+	return tokens
+}
+
+// completeRateLimit corrects a reservation with the usage logged for the
+// request, keeping the estimate when no usage is known
+func completeRateLimit(reservation *ratelimit.Reservation, requestLog *models.RequestLog) {
+	if reservation == nil {
+		return
+	}
+	if requestLog != nil && requestLog.AttemptCount == 0 {
+		// Cached answers and requests that failed before reaching an
+		// upstream use no upstream tokens
+		reservation.Complete(0)
+		return
+	}
+	if requestLog == nil || requestLog.Usage == "" {
+		reservation.Complete(-1)
+		return
+	}
+
+	var usage models.UsageData
+	if err := json.Unmarshal([]byte(requestLog.Usage), &usage); err != nil {
+		log.Printf("Error parsing usage for rate limiting: %v", err)
+		reservation.Complete(-1)
+		return
+	}
+
+	tokens := usage.InputTokens + usage.OutputTokens
+	if usage.TotalTokens > 0 {
+		tokens = usage.TotalTokens
+	} else if usage.PromptTokens > 0 || usage.CompletionTokens > 0 {
+		tokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	reservation.Complete(tokens)
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for the retry-after
+// header
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// setAnthropicRateLimitHeaders sets the headers the Anthropic API sends with
+// rate limited responses
+func setAnthropicRateLimitHeaders(w http.ResponseWriter, result *ratelimit.Result) {
+	if result.Requests != nil {
+		w.Header().Set("anthropic-ratelimit-requests-limit", strconv.Itoa(result.Requests.Limit))
+		w.Header().Set("anthropic-ratelimit-requests-remaining", strconv.Itoa(result.Requests.Remaining))
+		w.Header().Set("anthropic-ratelimit-requests-reset", result.Requests.Reset.UTC().Format(time.RFC3339))
+	}
+	if result.Tokens != nil {
+		w.Header().Set("anthropic-ratelimit-tokens-limit", strconv.Itoa(result.Tokens.Limit))
+		w.Header().Set("anthropic-ratelimit-tokens-remaining", strconv.Itoa(result.Tokens.Remaining))
+		w.Header().Set("anthropic-ratelimit-tokens-reset", result.Tokens.Reset.UTC().Format(time.RFC3339))
+	}
+	w.Header().Set("retry-after", retryAfterSeconds(result.RetryAfter))
+}
+
+// setOpenAIRateLimitHeaders sets the headers the OpenAI API sends with rate
+// limited responses, where resets are durations such as "1.5s"
+func setOpenAIRateLimitHeaders(w http.ResponseWriter, result *ratelimit.Result) {
+	now := time.Now()
+	if result.Requests != nil {
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(result.Requests.Limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(result.Requests.Remaining))
+		w.Header().Set("x-ratelimit-reset-requests", formatReset(result.Requests.Reset.Sub(now)))
+	}
+	if result.Tokens != nil {
+		w.Header().Set("x-ratelimit-limit-tokens", strconv.Itoa(result.Tokens.Limit))
+		w.Header().Set("x-ratelimit-remaining-tokens", strconv.Itoa(result.Tokens.Remaining))
+		w.Header().Set("x-ratelimit-reset-tokens", formatReset(result.Tokens.Reset.Sub(now)))
+	}
+	w.Header().Set("retry-after", retryAfterSeconds(result.RetryAfter))
+}
+
+// formatReset formats a duration in seconds with millisecond precision
+func formatReset(wait time.Duration) string {
+	if wait < 0 {
+		wait = 0
+	}
+	return fmt.Sprintf("%gs", math.Round(wait.Seconds()*1000)/1000)
+}
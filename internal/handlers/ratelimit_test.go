@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vitali/ai-gateway/internal/config"
+	"github.com/vitali/ai-gateway/internal/ratelimit"
+)
+
+// Requests that end before reaching an upstream give their reserved tokens
+// back, whichever way they end
+func TestRateLimitReleasedWithoutUpstream(t *testing.T) {
+	useTestDB(t)
+	rules := []ratelimit.Rule{{By: "model", TPM: 1000}}
+	cfg := config.Config{RateLimits: rules}
+	prompt := strings.Repeat("hello ", 200)
+
+	tests := []struct {
+		name  string
+		model string
+		send  func(w http.ResponseWriter, r *http.Request)
+		body  string
+	}{
+		{"unrouted message", "unrouted-message", func(w http.ResponseWriter, r *http.Request) { HandleMessages(w, r, cfg) },
+			`{"model":"unrouted-message","max_tokens":10,"messages":[{"role":"user","content":"` + prompt + `"}]}`},
+		{"unrouted chat completion", "unrouted-chat", func(w http.ResponseWriter, r *http.Request) { HandleChatCompletions(w, r, cfg) },
+			`{"model":"unrouted-chat","messages":[{"role":"user","content":"` + prompt + `"}]}`},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		tc.send(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body)))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: status %d, want 404", tc.name, rec.Code)
+		}
+
+		_, result := ratelimit.Reserve(rules, ratelimit.Subject{Model: tc.model}, 0)
+		if remaining := result.Tokens.Remaining; remaining < 999 {
+			t.Errorf("%s: %d tokens remaining, want the full 1000", tc.name, remaining)
+		}
+	}
+}
@@ -17,23 +17,50 @@ import (
 // HandleMessages handles the /v1/messages endpoint
 func HandleMessages(w http.ResponseWriter, r *http.Request, config config.Config) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+
+	virtualKey, err := authenticate(r, config)
+	if err != nil {
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+		return
+	}
+	if err := checkBudgets(w, virtualKey); err != nil {
+		writeAnthropicError(w, http.StatusPaymentRequired, "billing_error", err.Error())
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error reading request body")
 		return
 	}
 	defer r.Body.Close()
 
 	var anthropicReq models.AnthropicRequest
 	if err := json.Unmarshal(body, &anthropicReq); err != nil {
-		http.Error(w, "Error parsing request JSON", http.StatusBadRequest)
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error parsing request JSON: "+err.Error())
+		return
+	}
+
+	systemPrompt, err := converter.SystemPrompt(anthropicReq.System)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Error parsing system prompt: "+err.Error())
 		return
 	}
 
+	reservation, rateLimit := reserveRateLimit(r, config, virtualKey, anthropicReq.Model, body, "anthropic")
+	if rateLimit != nil && !rateLimit.Allowed {
+		setAnthropicRateLimitHeaders(w, rateLimit)
+		writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", rateLimit.Reason)
+		return
+	}
+	// Correct the reserved tokens with the actual usage once the response
+	// has been relayed and logged, or when the request ends early
+	var requestLog *models.RequestLog
+	defer func() { completeRateLimit(reservation, requestLog) }()
+
 	// Debug print for Anthropic request
 	anthropicDebug, _ := json.MarshalIndent(anthropicReq, "", "  ")
 	log.Printf("Incoming Anthropic request: %s", string(anthropicDebug))
@@ -55,62 +82,139 @@ func HandleMessages(w http.ResponseWriter, r *http.Request, config config.Config
 	}
 
 	// Log the request to the database
-	requestLog, err := db.LogRequest(r, "anthropic", string(body), anthropicReq.Model, anthropicReq.Stream, string(additionalParamsJSON))
+	requestLog, err = db.LogRequest(r, "anthropic", string(body), anthropicReq.Model, anthropicReq.Stream, string(additionalParamsJSON), systemPrompt)
 	if err != nil {
 		log.Printf("Error logging request: %v", err)
 		// Continue processing even if logging fails
 	}
+	if requestLog != nil && virtualKey != nil {
+		requestLog.KeyID = virtualKey.ID
+	}
 
-	openaiReq := converter.ConvertToOpenAI(anthropicReq)
+	targets, err := config.Resolve(anthropicReq.Model)
+	if err != nil {
+		responseBody := writeAnthropicError(w, http.StatusNotFound, "not_found_error", err.Error())
+		if requestLog != nil {
+			db.UpdateResponseLog(requestLog, http.StatusNotFound, nil, responseBody, 0, "")
+		}
+		return
+	}
+	log.Printf("Routing model %s to %d target(s), first %s as %s", anthropicReq.Model, len(targets), targets[0].Provider.Name, targets[0].Model)
+
+	// The OpenAI request is converted once and reused by every OpenAI-style
+	// target in the fallback chain
+	var openaiReq models.OpenAIRequest
+	if hasAPIStyle(targets, "openai") {
+		openaiReq, err = converter.ConvertToOpenAI(anthropicReq)
+		if err != nil {
+			responseBody := writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			if requestLog != nil {
+				db.UpdateResponseLog(requestLog, http.StatusBadRequest, nil, responseBody, 0, "")
+			}
+			return
+		}
+		if openaiReq.Stream && config.StreamUsage {
+			openaiReq.StreamOptions = &models.OpenAIStreamOptions{IncludeUsage: true}
+		}
+	}
+
+	// Deterministic requests may be answered from the response cache, which
+	// is keyed on the request converted to the OpenAI format. Anthropic-style
+	// targets receive the raw body, so the key is taken from it when one is
+	// in the chain, as the conversion drops fields such as thinking.
+	var cacheKey string
+	if hasAPIStyle(targets, "anthropic") {
+		cacheKey = rawResponseCacheKey(r, "anthropic", anthropicReq.Temperature, body)
+	} else {
+		cacheKey = responseCacheKey(r, "anthropic", openaiReq)
+	}
+	if cacheKey != "" && serveCached(w, cacheKey, requestLog, "anthropic", anthropicReq.Stream, false) {
+		return
+	}
+
+	startTime := time.Now()
+
+	resp, target, err := sendWithFallback(requestLog, targets, func(i int) (*http.Request, error) {
+		if targets[i].Provider.APIStyle == "anthropic" {
+			reqBody := body
+			if targets[i].Model != anthropicReq.Model {
+				var err error
+				if reqBody, err = replaceModel(body, targets[i].Model); err != nil {
+					return nil, err
+				}
+			}
+			return newAnthropicRequest(r, config, targets[i].Provider, reqBody)
+		}
+
+		upstreamReq := openaiReq
+		upstreamReq.Model = targets[i].Model
+		return newOpenAIRequest(r, targets[i].Provider, upstreamReq)
+	})
+	if err != nil && clientGone(r.Context()) {
+		logClientCancelled(requestLog, startTime, "", "")
+		return
+	}
+	if err != nil {
+		status, errType := gatewayError(err)
+		responseBody := writeAnthropicError(w, status, errType, err.Error())
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, status, nil, responseBody, processingTime, "")
+		}
+		return
+	}
+	defer resp.Body.Close()
 
-	ForwardRequest(w, r, openaiReq, config, requestLog, "anthropic")
+	if target.Provider.APIStyle == "anthropic" {
+		relayAnthropicResponse(w, resp, anthropicReq, requestLog, startTime)
+	} else {
+		openaiReq.Model = target.Model
+		relayOpenAIResponse(w, resp, openaiReq, requestLog, startTime, "anthropic")
+	}
+	storeCachedResponse(cacheKey, requestLog, anthropicReq.Stream)
 }
 
-// ForwardRequest forwards the request to the target API
-func ForwardRequest(w http.ResponseWriter, r *http.Request, openaiReq models.OpenAIRequest, config config.Config, requestLog *models.RequestLog, provider string) {
+// newOpenAIRequest builds a request to the chat completions endpoint of an
+// OpenAI-style provider
+func newOpenAIRequest(r *http.Request, provider config.Provider, openaiReq models.OpenAIRequest) (*http.Request, error) {
 	reqBody, err := json.Marshal(openaiReq)
 	if err != nil {
-		http.Error(w, "Error creating forwarded request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	openaiDebug, _ := json.MarshalIndent(openaiReq, "", "  ")
-	// TargetURL doesn't have "/" in the end as it's trimmed in config.go
-	url := config.TargetURL + "/chat/completions"
+	// BaseURL doesn't have "/" in the end as it's trimmed in config.go
+	url := provider.BaseURL + "/chat/completions"
 	log.Printf("Forwarding OpenAI request to %s: %s", url, string(openaiDebug))
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(reqBody)))
+	req, err := http.NewRequestWithContext(r.Context(), "POST", url, strings.NewReader(string(reqBody)))
 	if err != nil {
-		http.Error(w, "Error creating forwarded request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	setOpenAIAuth(req, r, provider)
 
-	if xAPIKey := r.Header.Get("x-api-key"); xAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+xAPIKey)
-	}
-
-	client := &http.Client{}
-
-	startTime := time.Now()
+	return req, nil
+}
 
-	if openaiReq.Stream {
-		HandleStreamingResponse(w, req, client, requestLog, openaiReq.Model, provider)
-		return
+// hasAPIStyle reports whether any target uses the given API style
+func hasAPIStyle(targets []config.Target, apiStyle string) bool {
+	for _, target := range targets {
+		if target.Provider.APIStyle == apiStyle {
+			return true
+		}
 	}
+	return false
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		// Log error response if we have a requestLog
-		if requestLog != nil {
-			processingTime := time.Since(startTime).Milliseconds()
-			db.UpdateResponseLog(requestLog, http.StatusInternalServerError, nil, err.Error(), processingTime, "")
-		}
+// relayOpenAIResponse converts the response of an OpenAI-style provider to
+// Anthropic format and writes it to the client
+func relayOpenAIResponse(w http.ResponseWriter, resp *http.Response, openaiReq models.OpenAIRequest, requestLog *models.RequestLog, startTime time.Time, requestType string) {
+	if openaiReq.Stream {
+		HandleStreamingResponse(w, resp, requestLog, openaiReq, requestType, startTime)
 		return
 	}
-	defer resp.Body.Close()
 
 	// Debug print for response status and headers
 	log.Printf("Response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
@@ -118,41 +222,34 @@ func ForwardRequest(w http.ResponseWriter, r *http.Request, openaiReq models.Ope
 	// Calculate processing time
 	processingTime := time.Since(startTime).Milliseconds()
 
-	// If the response is not successful, just pass it through
+	// Translate errors so Anthropic SDKs can parse them
 	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(resp.StatusCode)
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
-
-		// Read the response body for logging
-		responseBody, err := io.ReadAll(resp.Body)
+		upstreamBody, err := io.ReadAll(resp.Body)
 		if err != nil {
 			log.Printf("Error reading response body: %v", err)
-			return
 		}
+		copyRetryAfter(w, resp)
+		responseBody := writeTranslatedError(w, resp.StatusCode, upstreamBody)
 
-		// Log the error response
+		// Log the upstream error as received
 		if requestLog != nil {
-			db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(responseBody), processingTime, "")
-		}
-
-		// Write the response body to the client
-		if _, err := w.Write(responseBody); err != nil {
-			log.Printf("Error copying response: %v", err)
+			db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(upstreamBody), processingTime, "")
 		}
+		log.Printf("Upstream error %d translated to %s", resp.StatusCode, responseBody)
 		return
 	}
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "Error reading response body", http.StatusInternalServerError)
+		if responseClientGone(resp) {
+			logClientCancelled(requestLog, startTime, string(body), "")
+			return
+		}
+		responseBody := writeAnthropicError(w, http.StatusBadGateway, "api_error", "Error reading upstream response: "+err.Error())
 		// Log the error if we have a requestLog
 		if requestLog != nil {
-			db.UpdateResponseLog(requestLog, http.StatusInternalServerError, nil, "Error reading response body", processingTime, "")
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, nil, responseBody, processingTime, "")
 		}
 		return
 	}
@@ -161,23 +258,16 @@ func ForwardRequest(w http.ResponseWriter, r *http.Request, openaiReq models.Ope
 	var openaiResp models.OpenAIResponse
 	if err := json.Unmarshal(body, &openaiResp); err != nil {
 		log.Printf("Error parsing OpenAI response: %v", err)
-		// If we can't parse the response, just pass it through
-		w.WriteHeader(resp.StatusCode)
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
+		writeAnthropicError(w, http.StatusBadGateway, "api_error", "Error parsing upstream response: "+err.Error())
 		// Log the unparseable response
 		if requestLog != nil {
-			db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(body), processingTime, "")
+			db.UpdateResponseLog(requestLog, http.StatusBadGateway, resp.Header, string(body), processingTime, "")
 		}
-		w.Write(body)
 		return
 	}
 
 	// Convert the OpenAI response to Anthropic format
-	anthropicResp := converter.ConvertToAnthropic(openaiResp)
+	anthropicResp := converter.ConvertToAnthropic(openaiResp, openaiReq.Stop)
 
 	// Debug print for Anthropic response
 	anthropicDebug, _ := json.MarshalIndent(anthropicResp, "", "  ")
@@ -198,7 +288,7 @@ func ForwardRequest(w http.ResponseWriter, r *http.Request, openaiReq models.Ope
 
 	// Extract usage information if available
 	var usageJSON string
-	log.Printf("%s", openaiResp.Usage)
+	log.Printf("%+v", openaiResp.Usage)
 	if openaiResp.Usage.TotalTokens > 0 {
 		usageData, err := json.Marshal(openaiResp.Usage)
 		if err != nil {
@@ -211,6 +301,9 @@ func ForwardRequest(w http.ResponseWriter, r *http.Request, openaiReq models.Ope
 
 	// Log the successful response
 	if requestLog != nil {
+		if usageJSON != "" {
+			requestLog.UsageSource = "reported"
+		}
 		db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, string(responseJSON), processingTime, usageJSON)
 	}
 
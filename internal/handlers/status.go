@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/breaker"
+	"github.com/vitali/ai-gateway/internal/config"
+)
+
+// statusPageData is the data of the status page template
+type statusPageData struct {
+	Providers       []config.Provider
+	DefaultProvider string
+	Breakers        []breaker.Status
+}
+
+// HandleStatusPage renders a page with the configured providers and the
+// state of their circuit breakers
+func HandleStatusPage(w http.ResponseWriter, r *http.Request, config config.Config) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := statusPageData{
+		Providers:       config.Providers,
+		DefaultProvider: config.DefaultProvider,
+		Breakers:        breaker.All(),
+	}
+
+	// Load HTML template from file
+	tmplFile := "templates/status.html"
+
+	// Parse the template
+	t, err := template.New("status").ParseFiles(tmplFile)
+	if err != nil {
+		http.Error(w, "Error parsing template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.ExecuteTemplate(w, "status.html", data); err != nil {
+		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleMetrics exposes circuit breaker metrics in the Prometheus text format
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := breaker.All()
+
+	var b strings.Builder
+	b.WriteString("# HELP ai_gateway_circuit_breaker_state Circuit breaker state: 0 closed, 1 open, 2 half-open.\n")
+	b.WriteString("# TYPE ai_gateway_circuit_breaker_state gauge\n")
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "ai_gateway_circuit_breaker_state{%s} %d\n", metricLabels(status), status.State)
+	}
+
+	b.WriteString("# HELP ai_gateway_upstream_requests_total Upstream requests by outcome as seen by the circuit breaker.\n")
+	b.WriteString("# TYPE ai_gateway_upstream_requests_total counter\n")
+	for _, status := range statuses {
+		labels := metricLabels(status)
+		fmt.Fprintf(&b, "ai_gateway_upstream_requests_total{%s,result=\"success\"} %d\n", labels, status.Successes)
+		fmt.Fprintf(&b, "ai_gateway_upstream_requests_total{%s,result=\"failure\"} %d\n", labels, status.Errors)
+		fmt.Fprintf(&b, "ai_gateway_upstream_requests_total{%s,result=\"rejected\"} %d\n", labels, status.Rejected)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// metricLabels formats the provider and model labels of a breaker
+func metricLabels(status breaker.Status) string {
+	return fmt.Sprintf("provider=%q,model=%q", status.Provider, status.Model)
+}
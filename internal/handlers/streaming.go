@@ -7,136 +7,541 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/vitali/ai-gateway/internal/converter"
 	"github.com/vitali/ai-gateway/internal/db"
 	"github.com/vitali/ai-gateway/internal/models"
 	"github.com/vitali/ai-gateway/internal/token_counter"
 )
 
-// HandleStreamingResponse handles streaming responses from the API
-func HandleStreamingResponse(w http.ResponseWriter, req *http.Request, client *http.Client, requestLog *models.RequestLog, model string, provider string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// pingInterval is how often a ping event is sent while waiting for the
+// upstream, so that idle connections are not closed by proxies
+const pingInterval = 10 * time.Second
 
-	log.Printf("Starting streaming request to API")
-	startTime := time.Now()
+// maxStreamLineSize bounds a single SSE line from the upstream. Tool call
+// arguments can arrive in large fragments, so the bufio default is too small.
+const maxStreamLineSize = 1024 * 1024
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		if requestLog != nil {
-			processingTime := time.Since(startTime).Milliseconds()
-			db.UpdateResponseLog(requestLog, http.StatusInternalServerError, nil, err.Error(), processingTime, "")
-		}
-		return
-	}
-	defer resp.Body.Close()
+// incompleteStreamMessage is the error for an upstream stream that ended
+// before the response was complete
+const incompleteStreamMessage = "Upstream closed the stream before the response was complete"
 
-	log.Printf("Streaming response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
+// outputCounter counts the output tokens of a stream as deltas arrive
+type outputCounter interface {
+	Add(text string)
+	Total() (int, error)
+}
 
-	if requestLog != nil {
-		// We'll update the processing time at the end of streaming
-		db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, "Streaming response", 0, "")
+// streamWriter translates an OpenAI chat completion stream into the Anthropic
+// SSE event sequence:
+//
+//	message_start, ping, (content_block_start, content_block_delta*,
+//	content_block_stop)*, message_delta, message_stop
+//
+// OpenAI sends text and tool calls as deltas on a single choice, while
+// Anthropic expects each of them in its own indexed content block. OpenAI
+// may interleave the fragments of parallel tool calls, but Anthropic blocks
+// cannot be reopened once stopped, so a tool_use block stays open until the
+// end of the stream and whatever arrives for other blocks meanwhile is held
+// back and written as complete blocks by finish.
+type streamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mu      sync.Mutex // serializes writes from the ping goroutine
+
+	messageID     string
+	model         string
+	inputTokens   int
+	stopSequences []string
+
+	// counter counts the output tokens as they arrive, which are used unless
+	// the upstream reported usage
+	counter outputCounter
+
+	nextIndex int
+	openIndex int // -1 when no block is open
+	openType  string
+
+	// toolBlocks maps an OpenAI tool call index to its Anthropic block index
+	toolBlocks map[int]int
+
+	// pending holds the blocks that arrived while a tool_use block was open
+	pending      []*pendingBlock
+	pendingTools map[int]*pendingBlock // by OpenAI tool call index
+
+	output       strings.Builder // text and tool call arguments
+	text         strings.Builder // text only, to detect stop sequences
+	finishReason string
+	matchedStop  string
+	outputTokens int
+	finished     bool
+	done         bool // [DONE] was received
+
+	// usage is the usage reported by the upstream, if any
+	usage *models.OpenAIUsage
+
+	// message assembles the events written, for the response cache
+	message *messageAssembler
+
+	// failure is the error event that ended the stream, with its status
+	failure       string
+	failureStatus int
+
+	// writeFailed is set once a write to the client fails, which means the
+	// client has gone away
+	writeFailed bool
+}
+
+// pendingBlock is a text or tool_use block held back by the streamWriter
+type pendingBlock struct {
+	blockType string
+	id        string
+	name      string
+	content   strings.Builder // text or tool call arguments
+}
+
+func newStreamWriter(w http.ResponseWriter, flusher http.Flusher, messageID string, model string, inputTokens int) *streamWriter {
+	return &streamWriter{
+		w:            w,
+		flusher:      flusher,
+		messageID:    messageID,
+		model:        model,
+		inputTokens:  inputTokens,
+		counter:      token_counter.NewOutputCounter(model),
+		openIndex:    -1,
+		toolBlocks:   make(map[int]int),
+		pendingTools: make(map[int]*pendingBlock),
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-		return
+// writeEvent marshals data and writes it as a single SSE event
+func (s *streamWriter) writeEvent(event string, data interface{}) error {
+	eventJSON, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error marshaling %s event: %v", event, err)
+		return err
 	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write([]byte("event: " + event + "\ndata: " + string(eventJSON) + "\n\n")); err != nil {
+		log.Printf("Error writing %s event: %v", event, err)
+		s.writeFailed = true
+		return err
 	}
+	s.flusher.Flush()
+	s.message.add(eventJSON)
+	return nil
+}
+
+func (s *streamWriter) writePing() error {
+	return s.writeEvent("ping", struct {
+		Type string `json:"type"`
+	}{
+		Type: "ping",
+	})
+}
+
+// keepAlive sends a ping every interval until the returned function is called
+func (s *streamWriter) keepAlive(interval time.Duration) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.writePing(); err != nil {
+					return
+				}
+			}
+		}
+	}()
 
-	messageID := db.GenerateRandomID()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
 
-	initialEvent := struct {
-		Type  string `json:"type"`
-		Message struct {
-			Content []string `json:"content"`
-		} `json:"message"`
-		Id    string `json:"id"`
-		Model string `json:"model"`
-		Role  string `json:"role"`
+// start writes the message_start event followed by the initial ping
+func (s *streamWriter) start() error {
+	message := struct {
+		Id           string                    `json:"id"`
+		Type         string                    `json:"type"`
+		Role         string                    `json:"role"`
+		Model        string                    `json:"model"`
+		Content      []models.AnthropicContent `json:"content"`
+		StopReason   *string                   `json:"stop_reason"`
+		StopSequence *string                   `json:"stop_sequence"`
+		Usage        models.AnthropicUsage     `json:"usage"`
 	}{
-		Type:    "message_start",
-		Id:      messageID,
-		Model:   model,
+		Id:      s.messageID,
+		Type:    "message",
 		Role:    "assistant",
-		Message: struct {
-			Content []string `json:"content"`
-		    }{
-		    Content: []string{},
-		    },
+		Model:   s.model,
+		Content: []models.AnthropicContent{},
+		Usage: models.AnthropicUsage{
+			InputTokens:  s.inputTokens,
+			OutputTokens: 1,
+		},
 	}
 
-	initialJSON, err := json.Marshal(initialEvent)
+	err := s.writeEvent("message_start", struct {
+		Type    string      `json:"type"`
+		Message interface{} `json:"message"`
+	}{
+		Type:    "message_start",
+		Message: message,
+	})
 	if err != nil {
-		log.Printf("Error marshaling initial event: %v", err)
-		http.Error(w, "Error creating streaming response", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	_, writeErr := w.Write([]byte("event: message_start\ndata: " + string(initialJSON) + "\n\n"))
-	if writeErr != nil {
-		log.Printf("Error writing initial event: %v", writeErr)
-		return
+	return s.writePing()
+}
+
+// startBlock closes the open block, if any, and opens a new one
+func (s *streamWriter) startBlock(contentBlock interface{}, blockType string) error {
+	if err := s.stopBlock(); err != nil {
+		return err
+	}
+
+	s.openIndex = s.nextIndex
+	s.openType = blockType
+	s.nextIndex++
+
+	return s.writeEvent("content_block_start", struct {
+		Type         string      `json:"type"`
+		Index        int         `json:"index"`
+		ContentBlock interface{} `json:"content_block"`
+	}{
+		Type:         "content_block_start",
+		Index:        s.openIndex,
+		ContentBlock: contentBlock,
+	})
+}
+
+// stopBlock closes the open block, if any
+func (s *streamWriter) stopBlock() error {
+	if s.openIndex < 0 {
+		return nil
 	}
-	flusher.Flush()
 
-	contentStartEvent := struct {
+	index := s.openIndex
+	s.openIndex = -1
+	s.openType = ""
+
+	return s.writeEvent("content_block_stop", struct {
 		Type  string `json:"type"`
 		Index int    `json:"index"`
-		ContentBlock struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
-		} `json:"content_block"`
 	}{
-		Type:  "content_block_start",
-		Index: 0,
-		ContentBlock: struct {
+		Type:  "content_block_stop",
+		Index: index,
+	})
+}
+
+// writeText emits a text delta, opening a text block first if needed. Text
+// that arrives while a tool_use block is open is held back.
+func (s *streamWriter) writeText(text string) error {
+	if s.openType == "tool_use" {
+		if n := len(s.pending); n == 0 || s.pending[n-1].blockType != "text" {
+			s.pending = append(s.pending, &pendingBlock{blockType: "text"})
+		}
+		s.pending[len(s.pending)-1].content.WriteString(text)
+		return nil
+	}
+
+	if s.openType != "text" {
+		err := s.startBlock(struct {
 			Type string `json:"type"`
 			Text string `json:"text"`
 		}{
 			Type: "text",
 			Text: "",
+		}, "text")
+		if err != nil {
+			return err
+		}
+	}
+
+	if text == "" {
+		return nil
+	}
+
+	return s.writeEvent("content_block_delta", models.AnthropicStreamingChunk{
+		Type:  "content_block_delta",
+		Index: s.openIndex,
+		Delta: models.AnthropicDelta{
+			Type: "text_delta",
+			Text: text,
 		},
+	})
+}
+
+// writeToolCall emits a tool call fragment. The first fragment for an OpenAI
+// tool call index opens a new tool_use block; later fragments carry argument
+// JSON that is forwarded as input_json_delta events. Tool calls that start
+// while another tool_use block is open are held back.
+func (s *streamWriter) writeToolCall(toolCall models.OpenAIStreamingToolCall) error {
+	if block, ok := s.pendingTools[toolCall.Index]; ok {
+		block.content.WriteString(toolCall.Function.Arguments)
+		return nil
+	}
+
+	index, ok := s.toolBlocks[toolCall.Index]
+	if !ok && s.openType == "tool_use" {
+		block := &pendingBlock{blockType: "tool_use", id: toolCall.Id, name: toolCall.Function.Name}
+		block.content.WriteString(toolCall.Function.Arguments)
+		s.pending = append(s.pending, block)
+		s.pendingTools[toolCall.Index] = block
+		return nil
+	}
+	if !ok {
+		if err := s.startToolBlock(toolCall.Id, toolCall.Function.Name); err != nil {
+			return err
+		}
+		index = s.openIndex
+		s.toolBlocks[toolCall.Index] = index
+	}
+
+	return s.writeArguments(index, toolCall.Function.Arguments)
+}
+
+// startToolBlock opens a tool_use block
+func (s *streamWriter) startToolBlock(id string, name string) error {
+	return s.startBlock(struct {
+		Type  string          `json:"type"`
+		Id    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	}{
+		Type:  "tool_use",
+		Id:    id,
+		Name:  name,
+		Input: json.RawMessage("{}"),
+	}, "tool_use")
+}
+
+// writeArguments emits tool call arguments as an input_json_delta
+func (s *streamWriter) writeArguments(index int, arguments string) error {
+	if arguments == "" {
+		return nil
+	}
+
+	return s.writeEvent("content_block_delta", models.AnthropicStreamingChunk{
+		Type:  "content_block_delta",
+		Index: index,
+		Delta: models.AnthropicDelta{
+			Type:        "input_json_delta",
+			PartialJson: arguments,
+		},
+	})
+}
+
+// writePending writes the blocks that were held back, each as a complete
+// block
+func (s *streamWriter) writePending() error {
+	for _, block := range s.pending {
+		if err := s.stopBlock(); err != nil {
+			return err
+		}
+		if block.blockType == "text" {
+			if err := s.writeText(block.content.String()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.startToolBlock(block.id, block.name); err != nil {
+			return err
+		}
+		if err := s.writeArguments(s.openIndex, block.content.String()); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+// handleChunk translates a single OpenAI chunk
+func (s *streamWriter) handleChunk(chunk models.OpenAIStreamingChunk) error {
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+
+	if choice.Delta.Content != "" {
+		s.addOutput(choice.Delta.Content)
+		s.text.WriteString(choice.Delta.Content)
+		if err := s.writeText(choice.Delta.Content); err != nil {
+			return err
+		}
+	}
+
+	for _, toolCall := range choice.Delta.ToolCalls {
+		// Arguments count towards output tokens just like text
+		s.addOutput(toolCall.Function.Name)
+		s.addOutput(toolCall.Function.Arguments)
+		if err := s.writeToolCall(toolCall); err != nil {
+			return err
+		}
+	}
+
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+	if matched := converter.MatchedStopSequence(choice.StopReason, choice.MatchedStop); matched != "" {
+		s.matchedStop = matched
+	}
+	return nil
+}
+
+// finish closes the open block and writes message_delta and message_stop.
+// Clients expect at least one content block, so an empty text block is
+// emitted if the upstream sent nothing.
+func (s *streamWriter) finish() error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+
+	if s.nextIndex == 0 {
+		if err := s.writeText(""); err != nil {
+			return err
+		}
+	}
+	if err := s.writePending(); err != nil {
+		return err
+	}
+	if err := s.stopBlock(); err != nil {
+		return err
+	}
+
+	s.countOutputTokens()
+
+	stopReason, stopSequence := converter.ConvertStopReason(s.finishReason, len(s.toolBlocks)+len(s.pendingTools) > 0, s.text.String(), s.matchedStop, s.stopSequences)
+	var stopSequenceValue *string
+	if stopSequence != "" {
+		stopSequenceValue = &stopSequence
 	}
 
-	contentStartJSON, err := json.Marshal(contentStartEvent)
+	err := s.writeEvent("message_delta", struct {
+		Type  string `json:"type"`
+		Delta struct {
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		} `json:"delta"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens,omitempty"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}{
+		Type: "message_delta",
+		Delta: struct {
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		}{
+			StopReason:   stopReason,
+			StopSequence: stopSequenceValue,
+		},
+		Usage: struct {
+			InputTokens  int `json:"input_tokens,omitempty"`
+			OutputTokens int `json:"output_tokens"`
+		}{
+			InputTokens:  s.reportedInputTokens(),
+			OutputTokens: s.outputTokens,
+		},
+	})
 	if err != nil {
-		log.Printf("Error marshaling content start event: %v", err)
-		http.Error(w, "Error creating streaming response", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	_, writeErr = w.Write([]byte("event: content_block_start\ndata: " + string(contentStartJSON) + "\n\n"))
-	if writeErr != nil {
-		log.Printf("Error writing content start event: %v", writeErr)
-		return
+	return s.writeEvent("message_stop", struct {
+		Type string `json:"type"`
+	}{
+		Type: "message_stop",
+	})
+}
+
+// fail ends the stream with an error event, as the Anthropic API does when a
+// stream fails part way through. No message_delta or message_stop follows.
+func (s *streamWriter) fail(status int, errorType string, message string) error {
+	if s.finished {
+		return nil
 	}
-	flusher.Flush()
+	s.finished = true
 
-	var fullTextOutput strings.Builder
-	var usageJSON string
+	body := anthropicError{Type: "error"}
+	body.Error.Type = errorType
+	body.Error.Message = message
+	bodyJSON, _ := json.Marshal(body)
+	s.failure = string(bodyJSON)
+	s.failureStatus = status
 
-	var inputTokens int
-	if requestLog != nil {
-		var err error
-		inputTokens, err = token_counter.CountTokensInRequest(requestLog.RequestBody, provider)
+	return s.writeEvent("error", body)
+}
+
+// addOutput records a delta of the output
+func (s *streamWriter) addOutput(text string) {
+	s.output.WriteString(text)
+	s.counter.Add(text)
+}
+
+// countOutputTokens sets the output tokens from the reported usage, or counts
+// the output so far
+func (s *streamWriter) countOutputTokens() {
+	if s.usage != nil {
+		s.outputTokens = s.usage.CompletionTokens
+		log.Printf("Using reported usage: %+v", *s.usage)
+	} else if s.output.Len() > 0 {
+		outputTokens, err := s.counter.Total()
 		if err != nil {
-			log.Printf("Error counting tokens in request: %v", err)
+			log.Printf("Error counting tokens in response: %v", err)
 		} else {
-			log.Printf("Counted %d tokens in request", inputTokens)
+			s.outputTokens = outputTokens
+			log.Printf("Counted %d tokens in response", outputTokens)
 		}
 	}
+}
+
+// reportedInputTokens returns the prompt tokens reported by the upstream, or
+// zero when usage was not reported and message_start already carried the
+// estimate
+func (s *streamWriter) reportedInputTokens() int {
+	if s.usage == nil {
+		return 0
+	}
+	return s.usage.PromptTokens
+}
 
-	scanner := bufio.NewScanner(resp.Body)
+// succeeded reports whether the upstream delivered the whole stream. An
+// error event counts like an error response, so rate limits are no failure.
+func (s *streamWriter) succeeded() bool {
+	if s.failure != "" {
+		return s.failureStatus < 500
+	}
+	return s.done || s.finishReason != ""
+}
+
+// translate reads the OpenAI SSE stream from body until [DONE] or EOF and
+// writes the translated events. Only read errors are returned; when the
+// client goes away translation simply stops.
+func (s *streamWriter) translate(body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -152,84 +557,9 @@ func HandleStreamingResponse(w http.ResponseWriter, req *http.Request, client *h
 
 		if data == "[DONE]" {
 			log.Printf("Received [DONE] from OpenAI")
-			contentStopEvent := struct {
-				Type  string `json:"type"`
-				Index int    `json:"index"`
-			}{
-				Type:  "content_block_stop",
-				Index: 0,
-			}
-
-			contentStopJSON, err := json.Marshal(contentStopEvent)
-			if err != nil {
-				log.Printf("Error marshaling content stop event: %v", err)
-				continue
-			}
-
-			_, writeErr := w.Write([]byte("event: content_block_stop\ndata: " + string(contentStopJSON) + "\n\n"))
-			if writeErr != nil {
-				log.Printf("Error writing content stop event: %v", writeErr)
-			}
-			flusher.Flush()
-
-			var outputTokens int
-			if fullTextOutput.Len() > 0 {
-				var err error
-				outputTokens, err = token_counter.CountTokensInResponse(fullTextOutput.String(), model)
-				if err != nil {
-					log.Printf("Error counting tokens in response: %v", err)
-				} else {
-					log.Printf("Counted %d tokens in response at [DONE]", outputTokens)
-				}
-			}
-
-			messageStopEvent := struct {
-				Type  string `json:"type"`
-				Id    string `json:"id"`
-				Role  string `json:"role"`
-				Usage struct {
-					InputTokens  int `json:"input_tokens"`
-					OutputTokens int `json:"output_tokens"`
-				} `json:"usage"`
-			}{
-				Type: "message_stop",
-				Id:   messageID,
-				Role: "assistant",
-				Usage: struct {
-					InputTokens  int `json:"input_tokens"`
-					OutputTokens int `json:"output_tokens"`
-				}{
-					InputTokens:  inputTokens,
-					OutputTokens: outputTokens,
-				},
-			}
-
-			usageData, err := token_counter.CreateUsageJSON(inputTokens, outputTokens, provider)
-			if err != nil {
-				log.Printf("Error creating usage JSON: %v", err)
-			} else {
-				usageJSON = usageData
-				log.Printf("Created usage JSON for [DONE] event: %s", usageJSON)
-			}
-
-			messageStopJSON, err := json.Marshal(messageStopEvent)
-			if err != nil {
-				log.Printf("Error marshaling message stop event: %v", err)
-				continue
-			}
-
-			_, writeErr = w.Write([]byte("event: message_stop\ndata: " + string(messageStopJSON) + "\n\n"))
-			if writeErr != nil {
-				log.Printf("Error writing message stop event: %v", writeErr)
-			}
-			flusher.Flush()
-
-			_, writeErr = w.Write([]byte("event: done\ndata: [DONE]\n\n"))
-			if writeErr != nil {
-				log.Printf("Error writing [DONE] message: %v", writeErr)
-			}
-			flusher.Flush()
-			continue
+			s.done = true
+			s.finish()
+			return nil
 		}
 
 		var openaiChunk models.OpenAIStreamingChunk
@@ -240,65 +570,144 @@ func HandleStreamingResponse(w http.ResponseWriter, req *http.Request, client *h
 			continue
 		}
 
-		if len(openaiChunk.Choices) == 0 || openaiChunk.Choices[0].Delta.Content == "" {
-			continue
+		if len(openaiChunk.Error) > 0 {
+			status, errorType, message := translateOpenAIError(http.StatusOK, []byte(data))
+			log.Printf("Upstream error in stream: %s", data)
+			s.fail(status, errorType, message)
+			return nil
 		}
 
-		fullTextOutput.WriteString(openaiChunk.Choices[0].Delta.Content)
-
-		anthropicChunk := models.AnthropicStreamingChunk{
-			Type:  "content_block_delta",
-			Index: 0, // Keep index at 0 for all text deltas
-			Delta: struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{
-				Type: "text_delta",
-				Text: openaiChunk.Choices[0].Delta.Content,
-			},
+		if err := s.handleChunk(openaiChunk); err != nil {
+			return nil
 		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 
-		anthropicJSON, err := json.Marshal(anthropicChunk)
-		log.Printf("Sending chunk: %s", string(anthropicJSON))
+	// Some upstreams close the stream without sending [DONE], which is fine
+	// once a finish_reason has arrived
+	if s.finishReason != "" {
+		s.finish()
+	} else {
+		log.Printf("Upstream stream ended without a finish_reason")
+		s.fail(http.StatusBadGateway, "api_error", incompleteStreamMessage)
+	}
+	return nil
+}
+
+// HandleStreamingResponse translates a streaming response from an
+// OpenAI-style provider into an Anthropic stream
+func HandleStreamingResponse(w http.ResponseWriter, resp *http.Response, requestLog *models.RequestLog, openaiReq models.OpenAIRequest, requestType string, startTime time.Time) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	log.Printf("Streaming response from API: status=%d, headers=%v", resp.StatusCode, resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		// Nothing has been streamed yet, so the error is sent as JSON
+		upstreamBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("Error marshaling Anthropic chunk: %v", err)
-			continue
+			log.Printf("Error reading response body: %v", err)
+		}
+		copyRetryAfter(w, resp)
+		writeTranslatedError(w, resp.StatusCode, upstreamBody)
+		if requestLog != nil {
+			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, string(upstreamBody), processingTime, "")
 		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Streaming not supported")
+		return
+	}
 
-		_, writeErr := w.Write([]byte("event: content_block_delta\ndata: " + string(anthropicJSON) + "\n\n"))
-		if writeErr != nil {
-			log.Printf("Error writing to response: %v", writeErr)
-			break
+	if requestLog != nil {
+		// We'll update the processing time at the end of streaming
+		db.UpdateResponseLog(requestLog, resp.StatusCode, resp.Header, "Streaming response", 0, "")
+	}
+
+	var inputTokens int
+	if requestLog != nil {
+		var err error
+		inputTokens, err = token_counter.CountTokensInRequest(requestLog.RequestBody, requestType)
+		if err != nil {
+			log.Printf("Error counting tokens in request: %v", err)
+		} else {
+			log.Printf("Counted %d tokens in request", inputTokens)
 		}
-		flusher.Flush()
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading from response: %v", err)
+	stream := newStreamWriter(w, flusher, "msg_"+db.GenerateRandomID(), openaiReq.Model, inputTokens)
+	stream.stopSequences = openaiReq.Stop
+	stream.message = newMessageAssembler()
+	if err := stream.start(); err != nil {
+		// Only a failed write stops the start, so the client is gone
+		logClientCancelled(requestLog, startTime, "", "")
+		return
+	}
+
+	stopPings := stream.keepAlive(pingInterval)
+	err := stream.translate(resp.Body)
+	stopPings()
+
+	if stream.writeFailed || (err != nil && responseClientGone(resp)) {
+		if stream.usage != nil {
+			inputTokens = stream.usage.PromptTokens
+		}
+		stream.countOutputTokens()
+
+		var usageJSON string
 		if requestLog != nil {
-			processingTime := time.Since(startTime).Milliseconds()
-			db.UpdateResponseLog(requestLog, http.StatusInternalServerError, nil, "Error reading from response: "+err.Error(), processingTime, "")
+			requestLog.UsageSource = "estimated"
+			if stream.usage != nil {
+				requestLog.UsageSource = "reported"
+			}
+			if usageJSON, err = token_counter.CreateUsageJSON(inputTokens, stream.outputTokens, requestType); err != nil {
+				log.Printf("Error creating usage JSON: %v", err)
+			}
 		}
-	} else {
-		log.Printf("Completed streaming response")
+		logClientCancelled(requestLog, startTime, stream.output.String(), usageJSON)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error reading from response: %v", err)
+		stream.fail(http.StatusBadGateway, "api_error", "Error reading from upstream: "+err.Error())
+	}
+	recordStreamOutcome(resp, stream.succeeded())
+	if stream.failure != "" {
 		if requestLog != nil {
 			processingTime := time.Since(startTime).Milliseconds()
+			db.UpdateResponseLog(requestLog, stream.failureStatus, resp.Header, stream.failure, processingTime, "")
+		}
+		return
+	}
 
-			outputTokens, err := token_counter.CountTokensInResponse(fullTextOutput.String(), model)
-			if err != nil {
-				log.Printf("Error counting tokens in response: %v", err)
-			} else {
-				log.Printf("Counted %d tokens in response", outputTokens)
-
-				usageJSON, err = token_counter.CreateUsageJSON(inputTokens, outputTokens, provider)
-				if err != nil {
-					log.Printf("Error creating usage JSON: %v", err)
-				} else {
-					log.Printf("Created usage JSON: %s", usageJSON)
-				}
-			}
+	log.Printf("Completed streaming response")
+	if requestLog != nil {
+		processingTime := time.Since(startTime).Milliseconds()
 
-			db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, fullTextOutput.String(), processingTime, usageJSON)
+		// Prefer the usage reported by the upstream over local estimates
+		requestLog.UsageSource = "estimated"
+		if stream.usage != nil {
+			inputTokens = stream.usage.PromptTokens
+			requestLog.UsageSource = "reported"
 		}
+
+		usageJSON, err := token_counter.CreateUsageJSON(inputTokens, stream.outputTokens, requestType)
+		if err != nil {
+			log.Printf("Error creating usage JSON: %v", err)
+		} else {
+			log.Printf("Created usage JSON: %s", usageJSON)
+		}
+
+		requestLog.StreamedResponse = stream.message.response()
+		db.UpdateResponseLog(requestLog, http.StatusOK, resp.Header, stream.output.String(), processingTime, usageJSON)
 	}
 }
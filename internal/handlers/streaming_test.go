@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vitali/ai-gateway/internal/db"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestStreamGolden translates the recorded OpenAI streams in testdata/streams
+// and compares the output with the matching Anthropic stream
+func TestStreamGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/streams/*.openai.sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden inputs found")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".openai.sse")
+		t.Run(name, func(t *testing.T) {
+			upstream, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			stream := newStreamWriter(rec, rec, "msg_golden", "gpt-4o-mini", 25)
+			stream.stopSequences = []string{"\n\nHuman:", "END"}
+			stream.counter = &wordCounter{}
+			if err := stream.start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.translate(bytes.NewReader(upstream)); err != nil {
+				t.Fatal(err)
+			}
+			got := rec.Body.Bytes()
+
+			golden := filepath.Join("testdata/streams", name+".anthropic.sse")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("stream mismatch\n--- got ---\n%s\n--- want ---\n%s", got, want)
+			}
+
+			checkEventOrder(t, got)
+		})
+	}
+}
+
+// TestRecordedStreamShape compares the goldens with the streams recorded
+// from the Anthropic API in testdata/streams/recorded. Every kind of event
+// the translator writes must occur in a recording, with the same fields and
+// JSON types.
+func TestRecordedStreamShape(t *testing.T) {
+	recordings, err := filepath.Glob("testdata/streams/recorded/*.sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) == 0 {
+		t.Fatal("no recorded streams found")
+	}
+
+	recorded := make(map[string]map[string]string)
+	for _, recording := range recordings {
+		stream, err := os.ReadFile(recording)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The protocol checks must accept what the API really sends
+		checkEventOrder(t, stream)
+		for _, event := range readEvents(t, stream) {
+			kind := eventKind(event)
+			if recorded[kind] == nil {
+				recorded[kind] = make(map[string]string)
+			}
+			eventShape(event.data, "", recorded[kind])
+		}
+	}
+
+	// Fields the API only sends in some streams
+	optional := map[string]bool{
+		"message_delta usage.input_tokens": true,
+	}
+
+	goldens, err := filepath.Glob("testdata/streams/*.anthropic.sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, golden := range goldens {
+		stream, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range readEvents(t, stream) {
+			kind := eventKind(event)
+			want, ok := recorded[kind]
+			if !ok {
+				t.Errorf("%s: no recorded %s event to compare with", golden, kind)
+				continue
+			}
+			got := make(map[string]string)
+			eventShape(event.data, "", got)
+
+			for field, wantType := range want {
+				gotType, ok := got[field]
+				if !ok && !optional[kind+" "+field] {
+					t.Errorf("%s: %s event lacks %s", golden, kind, field)
+				} else if ok && gotType != wantType && gotType != "null" && wantType != "null" {
+					t.Errorf("%s: %s event has %s of type %s, recorded %s", golden, kind, field, gotType, wantType)
+				}
+			}
+			for field := range got {
+				if _, ok := want[field]; !ok && !optional[kind+" "+field] {
+					t.Errorf("%s: %s event has %s, which is not recorded", golden, kind, field)
+				}
+			}
+		}
+	}
+}
+
+// sseEvent is an event of an Anthropic stream
+type sseEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// readEvents parses the events of an Anthropic stream. Each event must have
+// JSON data whose type is the event name.
+func readEvents(t *testing.T, stream []byte) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	scanner := bufio.NewScanner(bytes.NewReader(stream))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, sseEvent{name: strings.TrimPrefix(line, "event: ")})
+			continue
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if len(events) == 0 {
+				t.Fatalf("data without an event: %q", line)
+			}
+			event := &events[len(events)-1]
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+			if event.data["type"] != event.name {
+				t.Fatalf("event %q has data type %v", event.name, event.data["type"])
+			}
+		}
+	}
+	return events
+}
+
+// eventKind names an event by its type and, for blocks and deltas, the type
+// of the block or delta
+func eventKind(event sseEvent) string {
+	for _, field := range []string{"content_block", "delta"} {
+		if inner, ok := event.data[field].(map[string]interface{}); ok {
+			if innerType, ok := inner["type"].(string); ok {
+				return event.name + " " + innerType
+			}
+		}
+	}
+	return event.name
+}
+
+// eventShape records the JSON type of every field of value by its path
+func eventShape(value map[string]interface{}, prefix string, shape map[string]string) {
+	for key, field := range value {
+		path := prefix + key
+		switch field := field.(type) {
+		case map[string]interface{}:
+			shape[path] = "object"
+			eventShape(field, path+".", shape)
+		case []interface{}:
+			shape[path] = "array"
+		case string:
+			shape[path] = "string"
+		case float64:
+			shape[path] = "number"
+		case bool:
+			shape[path] = "bool"
+		case nil:
+			if _, ok := shape[path]; !ok {
+				shape[path] = "null"
+			}
+		}
+	}
+}
+
+// checkEventOrder verifies the stream follows the Anthropic protocol: one
+// message_start, balanced content blocks with increasing indices whose
+// deltas carry the index of the open block, then a single message_delta and
+// message_stop at the end, or an error event for a failed stream
+func checkEventOrder(t *testing.T, stream []byte) {
+	t.Helper()
+
+	var events []string
+	var indices []int
+	for _, event := range readEvents(t, stream) {
+		events = append(events, event.name)
+		index, ok := event.data["index"].(float64)
+		if !ok {
+			index = -1
+		}
+		indices = append(indices, int(index))
+	}
+
+	if len(events) < 3 || events[0] != "message_start" {
+		t.Fatalf("stream must begin with message_start, got %v", events)
+	}
+
+	// A failed stream ends with a single error event, possibly inside an
+	// open content block
+	if events[len(events)-1] == "error" {
+		for _, event := range events[1 : len(events)-1] {
+			if event == "error" || event == "message_delta" || event == "message_stop" {
+				t.Fatalf("unexpected %s before the error event: %v", event, events)
+			}
+		}
+		return
+	}
+
+	if len(events) < 4 || events[len(events)-2] != "message_delta" || events[len(events)-1] != "message_stop" {
+		t.Fatalf("stream must end with message_delta, message_stop, got %v", events)
+	}
+
+	open := false
+	blocks := 0
+	for i, event := range events[1 : len(events)-2] {
+		index := indices[i+1]
+		switch event {
+		case "ping":
+		case "content_block_start":
+			if open {
+				t.Fatalf("content_block_start while a block is open: %v", events)
+			}
+			if index != blocks {
+				t.Fatalf("content block %d started with index %d", blocks, index)
+			}
+			open = true
+			blocks++
+		case "content_block_delta":
+			if !open || index != blocks-1 {
+				t.Fatalf("content_block_delta for block %d outside it: %v", index, events)
+			}
+		case "content_block_stop":
+			if !open || index != blocks-1 {
+				t.Fatalf("content_block_stop for block %d outside it: %v", index, events)
+			}
+			open = false
+		default:
+			t.Fatalf("unexpected event %q: %v", event, events)
+		}
+	}
+	if open || blocks == 0 {
+		t.Fatalf("content blocks are not balanced: %v", events)
+	}
+}
+
+// wordCounter counts words instead of tokens, so that the goldens do not
+// depend on a tokenizer
+type wordCounter struct {
+	text strings.Builder
+}
+
+func (c *wordCounter) Add(text string) {
+	c.text.WriteString(text)
+}
+
+func (c *wordCounter) Total() (int, error) {
+	return len(strings.Fields(c.text.String())), nil
+}
+
+// brokenWriter fails every write, like the connection of a client that has
+// gone away
+type brokenWriter struct {
+	httptest.ResponseRecorder
+}
+
+func (w *brokenWriter) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestStreamStartFailureIsLoggedAsCancelled(t *testing.T) {
+	useTestDB(t)
+	requestLog := &models.RequestLog{RequestType: "anthropic", RequestBody: `{"model":"m","messages":[]}`}
+	if err := db.DB.Create(requestLog).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader("data: [DONE]\n\n")),
+	}
+	w := &brokenWriter{ResponseRecorder: *httptest.NewRecorder()}
+	HandleStreamingResponse(w, resp, requestLog, models.OpenAIRequest{Model: "m", Stream: true}, "anthropic", time.Now())
+
+	if err := db.DB.First(requestLog, requestLog.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if requestLog.ResponseStatus != models.StatusClientCancelled {
+		t.Errorf("logged status %d, want %d", requestLog.ResponseStatus, models.StatusClientCancelled)
+	}
+}
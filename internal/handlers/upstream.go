@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/config"
+)
+
+// setOpenAIAuth sets the bearer token for an OpenAI-style upstream. The
+// provider's own key is used when configured, otherwise the client's key is
+// forwarded, whether it came as a bearer token or as x-api-key.
+func setOpenAIAuth(req *http.Request, r *http.Request, provider config.Provider) {
+	if provider.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.APIKey)
+	} else if authorization := r.Header.Get("Authorization"); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	} else if xAPIKey := r.Header.Get("x-api-key"); xAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+xAPIKey)
+	}
+}
+
+// setAnthropicAuth sets x-api-key for an Anthropic upstream, using the
+// provider's key when configured or else the client's key
+func setAnthropicAuth(req *http.Request, r *http.Request, provider config.Provider) {
+	apiKey := provider.APIKey
+	if apiKey == "" {
+		apiKey = r.Header.Get("x-api-key")
+	}
+	if apiKey == "" {
+		apiKey = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+}
+
+// replaceModel rewrites the model field of a request body that is otherwise
+// forwarded unchanged, for routes that map to a different upstream model
+func replaceModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	modelJSON, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = modelJSON
+
+	return json.Marshal(fields)
+}
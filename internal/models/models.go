@@ -8,16 +8,32 @@ import (
 )
 
 type AnthropicRequest struct {
-	Model             string             `json:"model"`
-	MaxTokensToSample int                `json:"max_tokens"`
-	Messages          []AnthropicMessage `json:"messages"`
-	Stream            bool               `json:"stream,omitempty"`
-	Temperature       *float64           `json:"temperature,omitempty"`
-	TopP              *float64           `json:"top_p,omitempty"`
-	TopK              *int               `json:"top_k,omitempty"`
-	StopSequences     []string           `json:"stop_sequences,omitempty"`
-	PresencePenalty   *float64           `json:"presence_penalty,omitempty"`
-	FrequencyPenalty  *float64           `json:"frequency_penalty,omitempty"`
+	Model             string               `json:"model"`
+	MaxTokensToSample int                  `json:"max_tokens"`
+	System            json.RawMessage      `json:"system,omitempty"` // string or array of text blocks
+	Messages          []AnthropicMessage   `json:"messages"`
+	Stream            bool                 `json:"stream,omitempty"`
+	Temperature       *float64             `json:"temperature,omitempty"`
+	TopP              *float64             `json:"top_p,omitempty"`
+	TopK              *int                 `json:"top_k,omitempty"`
+	StopSequences     []string             `json:"stop_sequences,omitempty"`
+	PresencePenalty   *float64             `json:"presence_penalty,omitempty"`
+	FrequencyPenalty  *float64             `json:"frequency_penalty,omitempty"`
+	Tools             []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice        *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice is one of "auto", "any", "tool" (with Name) or "none"
+type AnthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse *bool  `json:"disable_parallel_tool_use,omitempty"`
 }
 
 type AnthropicMessage struct {
@@ -36,32 +52,174 @@ type AnthropicResponse struct {
 	Usage        AnthropicUsage     `json:"usage"`
 }
 
+// AnthropicContent is a content block. Text is set for "text" blocks,
+// Id/Name/Input for "tool_use" blocks, ToolUseId/Content/IsError for
+// "tool_result" blocks and Source/Title for "image" and "document" blocks.
 type AnthropicContent struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type      string           `json:"type"`
+	Text      string           `json:"text"`
+	Id        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseId string           `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage  `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+	Source    *AnthropicSource `json:"source,omitempty"`
+	Title     string           `json:"title,omitempty"`
+}
+
+// AnthropicSource is the source of an image or document block. Type is
+// "base64" (MediaType and Data), "url" (URL), "text" (Data, documents only)
+// or "file" (FileId).
+type AnthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+	FileId    string `json:"file_id,omitempty"`
+}
+
+// MarshalJSON omits the text field for non-text blocks, as tool_use blocks
+// must not carry it
+func (c AnthropicContent) MarshalJSON() ([]byte, error) {
+	type alias AnthropicContent
+	if c.Type == "text" {
+		return json.Marshal(alias(c))
+	}
+	return json.Marshal(struct {
+		alias
+		Text string `json:"text,omitempty"`
+	}{alias: alias(c), Text: c.Text})
 }
 
 type AnthropicUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
 }
 
 type OpenAIRequest struct {
-	Model            string         `json:"model"`
-	MaxTokens        int            `json:"max_tokens"`
-	Messages         []OpenAIMessage `json:"messages"`
-	Stream           bool           `json:"stream,omitempty"`
-	Temperature      *float64       `json:"temperature,omitempty"`
-	TopP             *float64       `json:"top_p,omitempty"`
-	N                *int           `json:"n,omitempty"`
-	Stop             []string       `json:"stop,omitempty"`
-	PresencePenalty  *float64       `json:"presence_penalty,omitempty"`
-	FrequencyPenalty *float64       `json:"frequency_penalty,omitempty"`
+	Model               string               `json:"model"`
+	MaxTokens           int                  `json:"max_tokens"`
+	MaxCompletionTokens int                  `json:"max_completion_tokens,omitempty"`
+	Messages            []OpenAIMessage      `json:"messages"`
+	Stream              bool                 `json:"stream,omitempty"`
+	Temperature         *float64             `json:"temperature,omitempty"`
+	TopP                *float64             `json:"top_p,omitempty"`
+	N                   *int                 `json:"n,omitempty"`
+	Stop                OpenAIStop           `json:"stop,omitempty"`
+	PresencePenalty     *float64             `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64             `json:"frequency_penalty,omitempty"`
+	Tools               []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice          interface{}          `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                `json:"parallel_tool_calls,omitempty"`
+	StreamOptions       *OpenAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// OpenAIStop holds the stop sequences, which OpenAI accepts either as a
+// single string or as an array
+type OpenAIStop []string
+
+func (s *OpenAIStop) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = OpenAIStop{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+// OpenAIStreamOptions asks the upstream to send a final chunk with usage
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type OpenAIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string           `json:"role"`
+	Content    OpenAIContent    `json:"content"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string           `json:"tool_call_id,omitempty"`
+}
+
+// OpenAIContent is message content, which is either a plain string or, for
+// multimodal messages, an array of parts. Parts takes precedence when set.
+type OpenAIContent struct {
+	Text  string
+	Parts []OpenAIContentPart
+}
+
+// OpenAIContentPart is a "text", "image_url" or "file" content part
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+	File     *OpenAIFile     `json:"file,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type OpenAIFile struct {
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	FileId   string `json:"file_id,omitempty"`
+}
+
+// PlainText returns the text of the content, concatenating text parts
+func (c OpenAIContent) PlainText() string {
+	if c.Parts == nil {
+		return c.Text
+	}
+	text := ""
+	for _, part := range c.Parts {
+		if part.Type == "text" {
+			text += part.Text
+		}
+	}
+	return text
+}
+
+func (c OpenAIContent) MarshalJSON() ([]byte, error) {
+	if c.Parts != nil {
+		return json.Marshal(c.Parts)
+	}
+	return json.Marshal(c.Text)
+}
+
+func (c *OpenAIContent) UnmarshalJSON(data []byte) error {
+	*c = OpenAIContent{}
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &c.Parts)
+	}
+	return json.Unmarshal(data, &c.Text)
+}
+
+type OpenAITool struct {
+	Type     string         `json:"type"`
+	Function OpenAIFunction `json:"function"`
+}
+
+type OpenAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	Id       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+type OpenAIFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 type OpenAIResponse struct {
@@ -77,6 +235,10 @@ type OpenAIChoice struct {
 	Index        int             `json:"index"`
 	Message      OpenAIMessage   `json:"message"`
 	FinishReason string          `json:"finish_reason"`
+	// StopReason (vLLM) and MatchedStop (SGLang) report which stop sequence
+	// ended the completion; either may also be a token id
+	StopReason  json.RawMessage `json:"stop_reason,omitempty"`
+	MatchedStop json.RawMessage `json:"matched_stop,omitempty"`
 }
 
 type OpenAIUsage struct {
@@ -86,25 +248,74 @@ type OpenAIUsage struct {
 }
 
 type OpenAIStreamingChunk struct {
-	Choices []struct {
-		Delta struct {
-			Content string `json:"content"`
-		} `json:"delta"`
-		FinishReason *string `json:"finish_reason"`
-	} `json:"choices"`
-	Id    string `json:"id"`
-	Model string `json:"model"`
+	Id      string                  `json:"id"`
+	Object  string                  `json:"object,omitempty"`
+	Created int64                   `json:"created,omitempty"`
+	Model   string                  `json:"model"`
+	Choices []OpenAIStreamingChoice `json:"choices"`
+	// Usage is only set on the final chunk when stream_options.include_usage
+	// was requested, and that chunk has no choices
+	Usage *OpenAIUsage `json:"usage,omitempty"`
+	// Error is set instead of choices by upstreams that fail mid-stream
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+type OpenAIStreamingChoice struct {
+	Index        int             `json:"index"`
+	Delta        OpenAIDelta     `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
+	StopReason   json.RawMessage `json:"stop_reason,omitempty"`
+	MatchedStop  json.RawMessage `json:"matched_stop,omitempty"`
+}
+
+type OpenAIDelta struct {
+	Role      string                    `json:"role,omitempty"`
+	Content   string                    `json:"content"`
+	ToolCalls []OpenAIStreamingToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIStreamingToolCall is a tool call fragment. Id, Type and Name are only
+// present in the first fragment for a given Index.
+type OpenAIStreamingToolCall struct {
+	Index    int                `json:"index"`
+	Id       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function OpenAIFunctionCall `json:"function"`
 }
 
 type AnthropicStreamingChunk struct {
-	Type    string `json:"type"`
-	Index   int    `json:"index"`
-	Delta   struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"delta"`
+	Type  string         `json:"type"`
+	Index int            `json:"index"`
+	Delta AnthropicDelta `json:"delta"`
+}
+
+// AnthropicStreamEvent is any event of an Anthropic SSE stream, as received
+// from an Anthropic upstream
+type AnthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Index        int                `json:"index"`
+	Message      *AnthropicResponse `json:"message,omitempty"`
+	ContentBlock *AnthropicContent  `json:"content_block,omitempty"`
+	Delta        AnthropicDelta     `json:"delta"`
+	Usage        *AnthropicUsage    `json:"usage,omitempty"`
+}
+
+// AnthropicDelta carries Text for "text_delta" and PartialJson for
+// "input_json_delta" events, or the stop reason of a message_delta event
+type AnthropicDelta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	PartialJson string `json:"partial_json,omitempty"`
+
+	// Set on message_delta events
+	StopReason   string `json:"stop_reason,omitempty"`
+	StopSequence string `json:"stop_sequence,omitempty"`
 }
 
+// StatusClientCancelled is the ResponseStatus of requests whose client
+// disconnected before the response was complete, as logged by nginx
+const StatusClientCancelled = 499
+
 // Database models for logging
 type RequestLog struct {
 	gorm.Model
@@ -115,15 +326,80 @@ type RequestLog struct {
 	RequestHeaders  string // JSON string of headers
 	RequestBody     string // JSON string of request body
 	RequestType     string // "anthropic" or "openai"
+	SystemPrompt    string // Top-level system prompt, flattened to text
 	ModelName       string // Renamed from Model to avoid conflict with gorm.Model
+	KeyID           uint      `gorm:"index"` // Virtual key used by the client, 0 when keys are not required
+	Provider        string // Name of the upstream provider that answered the request
+	UpstreamModel   string // Model name sent to that provider, which differs from ModelName after fallback
+	AttemptCount    int // Number of targets tried, more than 1 when a fallback was used
+	RetryCount      int // Retries made across all targets
+	BackoffMs       int64 // Total time spent waiting between retries, in milliseconds
 	IsStreaming     bool
 	ProcessingTime  int64 // in milliseconds
-	ResponseStatus  int
+	ResponseStatus  int // HTTP status, or StatusClientCancelled
 	ResponseHeaders string // JSON string of headers
 	ResponseBody    string // JSON string of response body
 	AdditionalParams string // JSON string of additional parameters like temperature, topK, etc.
 	Usage           string // JSON string of usage information (optional)
-	Cost            float64 // Cost of the request in USD
+	UsageSource     string // "reported" by the upstream or "estimated" with token_counter
+	UsageAccuracy   string // "exact" when reported by the upstream, else "approximate"
+	Cost            float64 // Cost of the request in USD, zero for cache hits
+	CacheHit        bool // Answered from the response cache without calling an upstream
+
+	// StreamedResponse is the complete response assembled from a stream in
+	// the client's format, kept for the response cache but not stored
+	StreamedResponse string `gorm:"-"`
+}
+
+// CachedResponse is a response stored by the response cache when it keeps
+// its entries in the database
+type CachedResponse struct {
+	Key         string `gorm:"primaryKey"` // Hex SHA-256 of the canonical request
+	Body        string // Response body in the client's format
+	Usage       string
+	UsageSource string
+	Provider    string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// VirtualKey is an API key issued by the gateway. Only the SHA-256 hash of
+// the key is stored; clients never see the upstream provider keys.
+type VirtualKey struct {
+	gorm.Model
+	Name       string
+	Project    string     // Optional group of keys, e.g. a team or an application
+	KeyHash    string     `gorm:"uniqueIndex"` // Hex SHA-256 of the key
+	KeyPrefix  string     // First characters of the key, to tell keys apart
+	RevokedAt  *time.Time // Set when the key is revoked
+	LastUsedAt *time.Time
+}
+
+// Budget caps the spend of a virtual key or of all keys in a project over a
+// period. Daily and monthly periods reset at UTC midnight and on the first of
+// the month; lifetime budgets never reset.
+type Budget struct {
+	gorm.Model
+	KeyID    uint    `gorm:"index"` // Virtual key the budget applies to, 0 for a project budget
+	Project  string  `gorm:"index"` // Project the budget applies to, empty for a key budget
+	Period   string  // "daily", "monthly" or "lifetime"
+	LimitUSD float64 // Requests are rejected once spend reaches this amount
+	WarnAt   float64 // Fraction of the limit after which responses carry a warning header, e.g. 0.8
+}
+
+// RequestAttempt is one upstream call made for a RequestLog. Requests with a
+// fallback chain have one attempt per target tried.
+type RequestAttempt struct {
+	gorm.Model
+	RequestLogID uint   `gorm:"index"`
+	Attempt      int    // 1 for the first target
+	Provider     string // Name of the provider called
+	ModelName    string // Model name sent upstream
+	Status       int    // HTTP status, 0 when no response was received
+	Error        string // Transport error or upstream error body
+	Retries      int    // Retries made on this target before it answered or gave up
+	Latency      int64  // Time until response headers, including retries, in milliseconds
+	Final        bool   // Whether this attempt's response was returned to the client
 }
 
 // UsageData represents the parsed usage information
@@ -138,12 +414,15 @@ type UsageData struct {
 	OutputTokens int `json:"output_tokens,omitempty"`
 }
 
-// Model pricing information
+// ModelPrice is the price of a model over a period. A model has one row per
+// price it has had, and the current one has no EffectiveTo.
 type ModelPrice struct {
 	gorm.Model
-	ModelName   string  `gorm:"index;unique"`
-	InputPrice  float64 // Price per input token in USD
-	OutputPrice float64 // Price per output token in USD
+	ModelName     string     `gorm:"index"`
+	InputPrice    float64    // Price per input token in USD
+	OutputPrice   float64    // Price per output token in USD
+	EffectiveFrom time.Time  `gorm:"index"`
+	EffectiveTo   *time.Time // Nil while the price is current
 }
 
 // ParsedRequestLog extends RequestLog with parsed usage data
@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule limits requests and tokens per minute for each virtual key, client IP
+// or model. Rules are set in the providers config file or with -rpm and -tpm.
+type Rule struct {
+	By  string `json:"by"`            // "key", "ip" or "model"
+	RPM int    `json:"rpm,omitempty"` // Requests per minute, 0 for no limit
+	TPM int    `json:"tpm,omitempty"` // Input and output tokens per minute, 0 for no limit
+}
+
+// Subject identifies who and what a request is counted against
+type Subject struct {
+	Key   string // Virtual key ID, empty when virtual keys are disabled
+	IP    string
+	Model string
+}
+
+func (s Subject) value(by string) string {
+	switch by {
+	case "key":
+		return s.Key
+	case "ip":
+		return s.IP
+	case "model":
+		return s.Model
+	}
+	return ""
+}
+
+// Limit is the state of the most restrictive limit of one kind, as reported
+// in the anthropic-ratelimit-* headers
+type Limit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time // When the bucket is full again
+}
+
+// Result is the outcome of a rate limit check
+type Result struct {
+	Allowed    bool
+	Reason     string        // Which limit was exceeded
+	RetryAfter time.Duration // How long until the request would be allowed
+	Requests   *Limit        // nil when no rule limits requests
+	Tokens     *Limit        // nil when no rule limits tokens
+}
+
+// bucket is a token bucket that refills its limit over one minute. The level
+// may become negative when actual usage exceeds the estimate, which delays
+// later requests until the debt is refilled.
+type bucket struct {
+	limit   float64
+	level   float64
+	updated time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.level = math.Min(b.limit, b.level+elapsed*b.limit/60)
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds the given amount
+func (b *bucket) wait(amount float64) time.Duration {
+	if b.level >= amount {
+		return 0
+	}
+	return time.Duration((amount - b.level) / b.limit * 60 * float64(time.Second))
+}
+
+func (b *bucket) state(now time.Time) Limit {
+	remaining := int(math.Max(0, math.Floor(b.level)))
+	return Limit{
+		Limit:     int(b.limit),
+		Remaining: remaining,
+		Reset:     now.Add(b.wait(b.limit)),
+	}
+}
+
+var (
+	mu        sync.Mutex
+	buckets   = make(map[string]*bucket)
+	lastPrune time.Time
+)
+
+// prune drops buckets that have been idle long enough to be full again, as
+// they are no different from new ones. It runs at most once a minute.
+func prune(now time.Time) {
+	if now.Sub(lastPrune) < time.Minute {
+		return
+	}
+	lastPrune = now
+
+	for k, b := range buckets {
+		if b.level+now.Sub(b.updated).Seconds()*b.limit/60 >= b.limit {
+			delete(buckets, k)
+		}
+	}
+}
+
+// getBucket returns the bucket for a rule and subject value, creating a full
+// one on first use. The limit is part of the key, so changed rules start
+// with fresh buckets.
+func getBucket(kind string, by string, value string, limit int, now time.Time) *bucket {
+	k := fmt.Sprintf("%s|%s|%d|%s", kind, by, limit, value)
+	b, ok := buckets[k]
+	if !ok {
+		b = &bucket{limit: float64(limit), level: float64(limit), updated: now}
+		buckets[k] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// Reservation holds the tokens taken for a request so they can be corrected
+// with the actual usage once the response is complete
+type Reservation struct {
+	tokens  int
+	buckets []*bucket
+}
+
+// Reserve checks every applicable rule and, if all of them allow the
+// request, takes one request and the estimated tokens from their buckets.
+// Nothing is taken from any bucket when a request is rejected. An estimate
+// larger than a TPM limit only needs a full bucket, so large requests are
+// slowed down rather than rejected forever.
+func Reserve(rules []Rule, subject Subject, estimatedTokens int) (*Reservation, Result) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	prune(now)
+	result := Result{Allowed: true}
+	var requestBuckets, tokenBuckets []*bucket
+
+	for _, rule := range rules {
+		value := subject.value(rule.By)
+		if value == "" {
+			continue
+		}
+
+		if rule.RPM > 0 {
+			b := getBucket("requests", rule.By, value, rule.RPM, now)
+			requestBuckets = append(requestBuckets, b)
+			if wait := b.wait(1); wait > 0 && result.Allowed {
+				result.Allowed = false
+				result.RetryAfter = wait
+				result.Reason = fmt.Sprintf("rate limit of %d requests per minute per %s exceeded", rule.RPM, rule.By)
+			}
+		}
+
+		if rule.TPM > 0 {
+			b := getBucket("tokens", rule.By, value, rule.TPM, now)
+			tokenBuckets = append(tokenBuckets, b)
+			if wait := b.wait(math.Min(float64(estimatedTokens), b.limit)); wait > 0 && result.Allowed {
+				result.Allowed = false
+				result.RetryAfter = wait
+				result.Reason = fmt.Sprintf("rate limit of %d tokens per minute per %s exceeded", rule.TPM, rule.By)
+			}
+		}
+	}
+
+	if result.Allowed {
+		for _, b := range requestBuckets {
+			b.level--
+		}
+		for _, b := range tokenBuckets {
+			b.level -= float64(estimatedTokens)
+		}
+	}
+
+	result.Requests = tightest(requestBuckets, now)
+	result.Tokens = tightest(tokenBuckets, now)
+
+	if !result.Allowed {
+		return nil, result
+	}
+	return &Reservation{tokens: estimatedTokens, buckets: tokenBuckets}, result
+}
+
+// tightest returns the state of the bucket with the fewest remaining units
+func tightest(buckets []*bucket, now time.Time) *Limit {
+	var limit *Limit
+	for _, b := range buckets {
+		state := b.state(now)
+		if limit == nil || state.Remaining < limit.Remaining {
+			limit = &state
+		}
+	}
+	return limit
+}
+
+// Complete replaces the estimated tokens of a reservation with the actual
+// usage. A negative count means the usage is unknown and keeps the estimate.
+func (r *Reservation) Complete(actualTokens int) {
+	if r == nil || actualTokens < 0 {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	for _, b := range r.buckets {
+		b.refill(now)
+		b.level -= float64(actualTokens - r.tokens)
+	}
+	r.tokens = actualTokens
+}
@@ -0,0 +1,175 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Policy configures how failed upstream calls are retried. Durations are in
+// milliseconds so the policy can be set in the providers config file.
+type Policy struct {
+	MaxRetries       int `json:"max_retries"`        // Retries after the first call, 0 disables retries
+	InitialBackoffMs int `json:"initial_backoff_ms"` // Backoff before the first retry, doubled for each retry after it
+	MaxBackoffMs     int `json:"max_backoff_ms"`     // Upper bound for the computed backoff
+	MaxWaitMs        int `json:"max_wait_ms"`        // Longest wait requested by the upstream that is honored
+}
+
+// DefaultPolicy is used for providers without a retry policy
+var DefaultPolicy = Policy{
+	MaxRetries:       2,
+	InitialBackoffMs: 500,
+	MaxBackoffMs:     8000,
+	MaxWaitMs:        30000,
+}
+
+// Stats describes the retries made for a call
+type Stats struct {
+	Retries int
+	Backoff time.Duration // Total time spent waiting between calls
+}
+
+// WithDefaults fills unset durations from DefaultPolicy
+func (p Policy) WithDefaults() Policy {
+	if p.InitialBackoffMs <= 0 {
+		p.InitialBackoffMs = DefaultPolicy.InitialBackoffMs
+	}
+	if p.MaxBackoffMs <= 0 {
+		p.MaxBackoffMs = DefaultPolicy.MaxBackoffMs
+	}
+	if p.MaxWaitMs <= 0 {
+		p.MaxWaitMs = DefaultPolicy.MaxWaitMs
+	}
+	return p
+}
+
+// Do sends req and retries connection resets and 429, 502, 503 and 504
+// responses. Upstream Retry-After and x-ratelimit-reset-* headers are
+// honored when present, otherwise the wait is a jittered exponential backoff.
+// Waiting stops when the request's context is cancelled. The last response
+// or error is returned once retries are exhausted, or when the upstream asks
+// to wait longer than MaxWaitMs.
+func Do(client *http.Client, req *http.Request, policy Policy) (*http.Response, Stats, error) {
+	policy = policy.WithDefaults()
+
+	var stats Stats
+	for {
+		resp, err := client.Do(req)
+		if stats.Retries >= policy.MaxRetries || !shouldRetry(resp, err) {
+			return resp, stats, err
+		}
+
+		wait := policy.backoff(stats.Retries)
+		if resp != nil {
+			if delay, ok := RetryDelay(resp.Header); ok {
+				if delay > time.Duration(policy.MaxWaitMs)*time.Millisecond {
+					log.Printf("Upstream asked to retry after %v, longer than the %dms limit", delay, policy.MaxWaitMs)
+					return resp, stats, nil
+				}
+				wait = delay
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, stats, fmt.Errorf("cannot retry request without GetBody")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, stats, err
+			}
+			req.Body = body
+		}
+
+		if resp != nil {
+			log.Printf("Retrying %s after status %d in %v", req.URL, resp.StatusCode, wait)
+		} else {
+			log.Printf("Retrying %s after error %v in %v", req.URL, err, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, stats, req.Context().Err()
+		case <-timer.C:
+		}
+
+		stats.Retries++
+		stats.Backoff += wait
+	}
+}
+
+// shouldRetry reports whether a call failed in a way that is safe to retry:
+// the upstream either rejected it before doing any work or the connection
+// broke before a response arrived
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before a retry, drawn from the upper half of the
+// exponential backoff so that concurrent clients spread out
+func (p Policy) backoff(retry int) time.Duration {
+	backoff := float64(p.InitialBackoffMs) * math.Pow(2, float64(retry))
+	if backoff > float64(p.MaxBackoffMs) {
+		backoff = float64(p.MaxBackoffMs)
+	}
+	jittered := backoff/2 + rand.Float64()*backoff/2
+	return time.Duration(jittered * float64(time.Millisecond))
+}
+
+// RetryDelay reads how long the upstream asked to wait from the Retry-After,
+// retry-after-ms or x-ratelimit-reset-* headers
+func RetryDelay(header http.Header) (time.Duration, bool) {
+	if value := header.Get("retry-after-ms"); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+
+	// OpenAI reports when each limit resets as a duration such as "6m0s".
+	// Prefer the limit that is exhausted, otherwise wait for both.
+	var delay time.Duration
+	found := false
+	for _, limit := range []string{"requests", "tokens"} {
+		reset, err := time.ParseDuration(header.Get("x-ratelimit-reset-" + limit))
+		if err != nil {
+			continue
+		}
+		if header.Get("x-ratelimit-remaining-"+limit) == "0" {
+			return reset, true
+		}
+		delay = max(delay, reset)
+		found = true
+	}
+	return delay, found
+}
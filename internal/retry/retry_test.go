@@ -0,0 +1,152 @@
+package retry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := Policy{InitialBackoffMs: 100, MaxBackoffMs: 1000}
+	for retry, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if got := policy.backoff(retry); got < want/2 || got > want {
+				t.Fatalf("retry %d: backoff %v, want between %v and %v", retry, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"none", nil, 0, false},
+		{"seconds", map[string]string{"Retry-After": "2"}, 2 * time.Second, true},
+		{"fractional seconds", map[string]string{"Retry-After": "0.5"}, 500 * time.Millisecond, true},
+		{"milliseconds first", map[string]string{"retry-after-ms": "1500", "Retry-After": "2"}, 1500 * time.Millisecond, true},
+		{"date in the past", map[string]string{"Retry-After": "Mon, 01 Jan 2024 00:00:00 GMT"}, 0, true},
+		{"invalid", map[string]string{"Retry-After": "soon"}, 0, false},
+		{"negative", map[string]string{"Retry-After": "-1"}, 0, false},
+		{"exhausted limit", map[string]string{
+			"x-ratelimit-reset-requests":     "6m0s",
+			"x-ratelimit-remaining-requests": "5",
+			"x-ratelimit-reset-tokens":       "2s",
+			"x-ratelimit-remaining-tokens":   "0",
+		}, 2 * time.Second, true},
+		{"longest reset", map[string]string{
+			"x-ratelimit-reset-requests": "1s",
+			"x-ratelimit-reset-tokens":   "3s",
+		}, 3 * time.Second, true},
+	}
+	for _, tc := range tests {
+		header := make(http.Header)
+		for key, value := range tc.header {
+			header.Set(key, value)
+		}
+		got, ok := RetryDelay(header)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	header := make(http.Header)
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got, ok := RetryDelay(header); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("date a minute ahead: got %v, %v", got, ok)
+	}
+}
+
+// statusServer answers with the given statuses in turn and checks that every
+// call carries the request body
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *int) {
+	t.Helper()
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); string(body) != "body" {
+			t.Errorf("call %d sent body %q", calls+1, body)
+		}
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statuses[min(calls, len(statuses)-1)])
+		calls++
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func post(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	header := http.Header{"Retry-After-Ms": {"1"}}
+	server, calls := statusServer(t, header, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+
+	resp, stats, err := Do(server.Client(), post(t, server.URL), Policy{MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || stats.Retries != 2 || *calls != 3 {
+		t.Errorf("got status %d after %d retries and %d calls, want 200 after 2 retries", resp.StatusCode, stats.Retries, *calls)
+	}
+	if stats.Backoff != 2*time.Millisecond {
+		t.Errorf("backoff %v, want the 2ms asked for", stats.Backoff)
+	}
+}
+
+func TestDoStopsAfterMaxRetries(t *testing.T) {
+	header := http.Header{"Retry-After-Ms": {"1"}}
+	server, calls := statusServer(t, header, http.StatusBadGateway)
+
+	resp, stats, err := Do(server.Client(), post(t, server.URL), Policy{MaxRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || stats.Retries != 2 || *calls != 3 {
+		t.Errorf("got status %d after %d retries and %d calls, want 502 after 2 retries", resp.StatusCode, stats.Retries, *calls)
+	}
+}
+
+func TestDoDoesNotRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+	}{
+		{"server error", http.StatusInternalServerError, nil},
+		{"client error", http.StatusBadRequest, nil},
+		{"wait above the limit", http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}}},
+	}
+	for _, tc := range tests {
+		server, calls := statusServer(t, tc.header, tc.status, http.StatusOK)
+
+		start := time.Now()
+		resp, stats, err := Do(server.Client(), post(t, server.URL), Policy{MaxRetries: 2, MaxWaitMs: 1000})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || stats.Retries != 0 || *calls != 1 {
+			t.Errorf("%s: got status %d after %d calls, want %d without retries", tc.name, resp.StatusCode, *calls, tc.status)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: returned after %v", tc.name, elapsed)
+		}
+	}
+}
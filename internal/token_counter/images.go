@@ -0,0 +1,94 @@
+package token_counter
+
+import (
+	"encoding/base64"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"strings"
+
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+// Anthropic images cost about width*height/750 tokens. Images with a long
+// edge above 1568 pixels are scaled down first, which caps the cost at about
+// 1600 tokens; that cap is also used when the dimensions are unknown.
+const (
+	anthropicMaxImageEdge   = 1568
+	anthropicMaxImageTokens = 1600
+)
+
+// OpenAI images cost 85 tokens at low detail. Otherwise the image is fitted
+// within 2048x2048, scaled so its short side is at most 768 pixels, and each
+// 512 pixel tile costs 170 tokens more. Images of unknown size are counted
+// as the largest possible after scaling, 2048x768 or 8 tiles.
+const (
+	openaiImageBaseTokens = 85
+	openaiImageTileTokens = 170
+	openaiMaxImageTokens  = openaiImageBaseTokens + 8*openaiImageTileTokens
+)
+
+// anthropicImageTokens estimates the tokens of an Anthropic image block
+func anthropicImageTokens(source *models.AnthropicSource) int {
+	if source == nil || source.Type != "base64" {
+		return anthropicMaxImageTokens
+	}
+	width, height, ok := imageSize(source.Data)
+	if !ok {
+		return anthropicMaxImageTokens
+	}
+
+	if long := math.Max(width, height); long > anthropicMaxImageEdge {
+		scale := anthropicMaxImageEdge / long
+		width, height = width*scale, height*scale
+	}
+	tokens := int(math.Ceil(width * height / 750))
+	if tokens > anthropicMaxImageTokens {
+		return anthropicMaxImageTokens
+	}
+	return tokens
+}
+
+// openaiImageTokens estimates the tokens of an OpenAI image_url part. Only
+// the size of data URLs is known without fetching the image.
+func openaiImageTokens(url string, detail string) int {
+	if detail == "low" {
+		return openaiImageBaseTokens
+	}
+
+	data, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return openaiMaxImageTokens
+	}
+	_, data, ok = strings.Cut(data, ";base64,")
+	if !ok {
+		return openaiMaxImageTokens
+	}
+	width, height, ok := imageSize(data)
+	if !ok {
+		return openaiMaxImageTokens
+	}
+
+	if long := math.Max(width, height); long > 2048 {
+		scale := 2048 / long
+		width, height = width*scale, height*scale
+	}
+	if short := math.Min(width, height); short > 768 {
+		scale := 768 / short
+		width, height = width*scale, height*scale
+	}
+	tiles := int(math.Ceil(width/512) * math.Ceil(height/512))
+	return openaiImageBaseTokens + tiles*openaiImageTileTokens
+}
+
+// imageSize reads the dimensions of a base64 encoded PNG, JPEG or GIF image
+// from its header, without decoding the pixels
+func imageSize(data string) (float64, float64, bool) {
+	config, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return 0, 0, false
+	}
+	return float64(config.Width), float64(config.Height), true
+}
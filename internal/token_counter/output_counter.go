@@ -0,0 +1,81 @@
+package token_counter
+
+// maxPendingBytes bounds the text an OutputCounter holds back when a
+// response has no word boundaries, such as long JSON arguments or CJK text
+const maxPendingBytes = 1024
+
+// OutputCounter counts the tokens of a streamed response as deltas arrive.
+// Text is counted as soon as a new word starts after it, which is where the
+// tokenizer splits text too, so each delta costs about the same to count
+// however long the response gets. The result matches counting the whole
+// text except at the rare boundaries forced by maxPendingBytes.
+type OutputCounter struct {
+	model   string
+	pending string
+	tokens  int
+	err     error
+}
+
+// NewOutputCounter returns a counter for the output of the given model
+func NewOutputCounter(model string) *OutputCounter {
+	return &OutputCounter{model: model}
+}
+
+// Add counts a delta of the response
+func (c *OutputCounter) Add(text string) {
+	if c.err != nil || text == "" {
+		return
+	}
+	c.pending += text
+
+	split := wordBoundary(c.pending)
+	if split <= 0 {
+		if len(c.pending) < maxPendingBytes {
+			return
+		}
+		split = len(c.pending)
+	}
+	c.count(c.pending[:split])
+	c.pending = c.pending[split:]
+}
+
+// Total returns the tokens of the response so far. The counter can still be
+// added to afterwards.
+func (c *OutputCounter) Total() (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.pending == "" {
+		return c.tokens, nil
+	}
+	tokens, err := CountTokens(c.pending, c.model)
+	if err != nil {
+		return 0, err
+	}
+	return c.tokens + tokens, nil
+}
+
+func (c *OutputCounter) count(text string) {
+	tokens, err := CountTokens(text, c.model)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.tokens += tokens
+}
+
+// wordBoundary returns the index of the last space that starts a word, that
+// is one following a non-space, or -1. Tokenizers keep such a space with the
+// word after it, so no token spans the boundary.
+func wordBoundary(text string) int {
+	for i := len(text) - 1; i > 0; i-- {
+		if text[i] == ' ' && !isSpace(text[i-1]) && i+1 < len(text) && !isSpace(text[i+1]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
@@ -3,30 +3,70 @@ package token_counter
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"strings"
+	"sync"
 
 	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/vitali/ai-gateway/internal/converter"
 	"github.com/vitali/ai-gateway/internal/models"
 )
 
+// Message framing overhead, as documented for OpenAI chat models: every
+// message is wrapped in role and separator tokens, and the reply is primed
+// with a few more. Other providers frame messages similarly.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
 // CountTokens counts the tokens in the given text using the specified model
 func CountTokens(text string, model string) (int, error) {
-	encoding := getEncodingForModel(model)
+	encoding := EncodingForModel(model)
 	if encoding == "" {
 		return 0, fmt.Errorf("unsupported model: %s", model)
 	}
 
-	tkm, err := tiktoken.GetEncoding(encoding)
+	tkm, err := getEncoder(encoding)
 	if err != nil {
-		return 0, fmt.Errorf("error getting encoding: %v", err)
+		return 0, err
 	}
 
 	tokens := tkm.Encode(text, nil, nil)
 	return len(tokens), nil
 }
 
-// CountTokensInRequest counts the tokens in the request body
+func init() {
+	// The BPE files of all supported encodings are embedded in the binary,
+	// so no network access is needed to count tokens
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   = make(map[string]*tiktoken.Tiktoken)
+)
+
+// getEncoder returns the encoder for an encoding, loading it on first use.
+// Building an encoder is far more expensive than encoding a message, and
+// encoders are safe for concurrent use, so one is shared per encoding.
+func getEncoder(encoding string) (*tiktoken.Tiktoken, error) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	if tkm, ok := encoders[encoding]; ok {
+		return tkm, nil
+	}
+	tkm, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("error getting encoding: %v", err)
+	}
+	encoders[encoding] = tkm
+	return tkm, nil
+}
+
+// CountTokensInRequest counts the tokens in the request body: message text
+// with its framing overhead, the system prompt, tool definitions, tool calls
+// and results, and images estimated from their dimensions
 func CountTokensInRequest(requestBody string, requestType string) (int, error) {
 	if requestType == "anthropic" {
 		var anthropicReq models.AnthropicRequest
@@ -34,56 +74,150 @@ func CountTokensInRequest(requestBody string, requestType string) (int, error) {
 			return 0, fmt.Errorf("error parsing Anthropic request: %v", err)
 		}
 
-		totalTokens := 0
+		counter := &requestCounter{model: anthropicReq.Model}
+
+		systemPrompt, err := converter.SystemPrompt(anthropicReq.System)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing system prompt: %v", err)
+		}
+		if systemPrompt != "" {
+			counter.message("system")
+			counter.text(systemPrompt)
+		}
+
+		// Tool definitions are sent to the model as part of the prompt
+		if len(anthropicReq.Tools) > 0 {
+			counter.json(anthropicReq.Tools)
+		}
+
+		counter.tokens += tokensPerReply
 		for _, message := range anthropicReq.Messages {
-			var contentStr string
+			counter.message(message.Role)
 
+			var contentStr string
 			if err := json.Unmarshal(message.Content, &contentStr); err == nil {
-				tokens, err := CountTokens(contentStr, anthropicReq.Model)
-				if err != nil {
-					return 0, err
-				}
-				totalTokens += tokens
-			} else {
-				var contentBlocks []models.AnthropicContent
-				if err := json.Unmarshal(message.Content, &contentBlocks); err != nil {
-					return 0, fmt.Errorf("error parsing message content: %v", err)
-				}
+				counter.text(contentStr)
+				continue
+			}
 
-				for _, block := range contentBlocks {
-					if block.Type == "text" {
-						tokens, err := CountTokens(block.Text, anthropicReq.Model)
-						if err != nil {
-							return 0, err
-						}
-						totalTokens += tokens
-					}
-				}
+			var contentBlocks []models.AnthropicContent
+			if err := json.Unmarshal(message.Content, &contentBlocks); err != nil {
+				return 0, fmt.Errorf("error parsing message content: %v", err)
 			}
+			counter.anthropicBlocks(contentBlocks)
 		}
 
-		return totalTokens, nil
+		return counter.tokens, counter.err
 	} else if requestType == "openai" {
 		var openaiReq models.OpenAIRequest
 		if err := json.Unmarshal([]byte(requestBody), &openaiReq); err != nil {
 			return 0, fmt.Errorf("error parsing OpenAI request: %v", err)
 		}
 
-		totalTokens := 0
+		counter := &requestCounter{model: openaiReq.Model}
+
+		if len(openaiReq.Tools) > 0 {
+			counter.json(openaiReq.Tools)
+		}
+
+		counter.tokens += tokensPerReply
 		for _, message := range openaiReq.Messages {
-			tokens, err := CountTokens(message.Content, openaiReq.Model)
-			if err != nil {
-				return 0, err
+			counter.message(message.Role)
+
+			if message.Content.Parts == nil {
+				counter.text(message.Content.Text)
+			}
+			for _, part := range message.Content.Parts {
+				switch part.Type {
+				case "text":
+					counter.text(part.Text)
+				case "image_url":
+					if part.ImageURL != nil {
+						counter.tokens += openaiImageTokens(part.ImageURL.URL, part.ImageURL.Detail)
+					}
+				}
+			}
+
+			for _, toolCall := range message.ToolCalls {
+				counter.text(toolCall.Function.Name)
+				counter.text(toolCall.Function.Arguments)
 			}
-			totalTokens += tokens
 		}
 
-		return totalTokens, nil
+		return counter.tokens, counter.err
 	}
 
 	return 0, fmt.Errorf("unsupported request type: %s", requestType)
 }
 
+// requestCounter adds up the tokens of a request, keeping the first error
+type requestCounter struct {
+	model  string
+	tokens int
+	err    error
+}
+
+func (c *requestCounter) text(text string) {
+	if c.err != nil || text == "" {
+		return
+	}
+	tokens, err := CountTokens(text, c.model)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.tokens += tokens
+}
+
+// message adds the framing of a message with the given role
+func (c *requestCounter) message(role string) {
+	c.tokens += tokensPerMessage
+	c.text(role)
+}
+
+// json counts a value as the JSON the model sees it as
+func (c *requestCounter) json(value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		if c.err == nil {
+			c.err = fmt.Errorf("error encoding %T: %v", value, err)
+		}
+		return
+	}
+	c.text(string(data))
+}
+
+// anthropicBlocks counts Anthropic content blocks, including the blocks
+// nested in tool results
+func (c *requestCounter) anthropicBlocks(blocks []models.AnthropicContent) {
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			c.text(block.Text)
+		case "image":
+			c.tokens += anthropicImageTokens(block.Source)
+		case "document":
+			if block.Source != nil && block.Source.Type == "text" {
+				c.text(block.Title)
+				c.text(block.Source.Data)
+			}
+		case "tool_use":
+			c.text(block.Name)
+			c.text(string(block.Input))
+		case "tool_result":
+			var contentStr string
+			if err := json.Unmarshal(block.Content, &contentStr); err == nil {
+				c.text(contentStr)
+				continue
+			}
+			var nested []models.AnthropicContent
+			if err := json.Unmarshal(block.Content, &nested); err == nil {
+				c.anthropicBlocks(nested)
+			}
+		}
+	}
+}
+
 // CountTokensInResponse counts the tokens in the response text
 func CountTokensInResponse(responseText string, model string) (int, error) {
 	return CountTokens(responseText, model)
@@ -116,21 +250,8 @@ func CreateUsageJSON(inputTokens int, outputTokens int, requestType string) (str
 	return string(usageJSON), nil
 }
 
-// getEncodingForModel returns the encoding name for the given model
-func getEncodingForModel(model string) string {
-	modelLower := strings.ToLower(model)
-
-	if strings.Contains(modelLower, "gpt-4") {
-		return "cl100k_base"
-	}
-	if strings.Contains(modelLower, "gpt-3.5-turbo") {
-		return "cl100k_base"
-	}
-
-	if strings.Contains(modelLower, "claude") {
-		return "cl100k_base"  // Using the same encoding as GPT-4 for Claude models
-	}
-
-	log.Printf("Unknown model: %s, using cl100k_base encoding", model)
-	return "cl100k_base"
+// EncodingForModel returns the name of the encoding used to count tokens for
+// the given model
+func EncodingForModel(model string) string {
+	return TokenizerForModel(model).Encoding
 }
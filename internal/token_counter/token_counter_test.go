@@ -0,0 +1,164 @@
+package token_counter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/vitali/ai-gateway/internal/models"
+)
+
+const benchModel = "gpt-4o-mini"
+
+// requireEncoding skips when the encoding of the benchmark model cannot be
+// loaded
+func requireEncoding(tb testing.TB) {
+	tb.Helper()
+	if _, err := CountTokens("hello", benchModel); err != nil {
+		tb.Skipf("encoding unavailable: %v", err)
+	}
+}
+
+// streamDeltas returns the deltas of a streamed response of about n words
+func streamDeltas(n int) []string {
+	words := strings.Fields("The quick brown fox jumps over the lazy dog, then writes func main() { fmt.Println(42) } and 3.14159 ∑ café 東京.\n\n")
+	deltas := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		deltas = append(deltas, " "+words[i%len(words)])
+	}
+	return deltas
+}
+
+func TestOutputCounterMatchesWholeText(t *testing.T) {
+	requireEncoding(t)
+
+	deltas := streamDeltas(2000)
+	counter := NewOutputCounter(benchModel)
+	for _, delta := range deltas {
+		counter.Add(delta)
+	}
+	got, err := counter.Total()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := CountTokens(strings.Join(deltas, ""), benchModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("incremental count %d, whole text count %d", got, want)
+	}
+}
+
+// pngData returns a base64 encoded PNG of the given size
+func pngData(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// The expected values are the examples in the providers' vision docs
+func TestImageTokens(t *testing.T) {
+	anthropic := []struct {
+		width, height, want int
+	}{
+		{200, 200, 54},
+		{1000, 1000, 1334},
+		{1092, 1092, 1590},
+		{4000, 3000, 1600},
+	}
+	for _, tc := range anthropic {
+		source := &models.AnthropicSource{Type: "base64", MediaType: "image/png", Data: pngData(t, tc.width, tc.height)}
+		if got := anthropicImageTokens(source); got != tc.want {
+			t.Errorf("Anthropic %dx%d: got %d tokens, want %d", tc.width, tc.height, got, tc.want)
+		}
+	}
+
+	openai := []struct {
+		width, height int
+		detail        string
+		want          int
+	}{
+		{1024, 1024, "high", 765},
+		{2048, 4096, "high", 1105},
+		{2048, 2048, "low", 85},
+		{300, 200, "", 255},
+	}
+	for _, tc := range openai {
+		url := "data:image/png;base64," + pngData(t, tc.width, tc.height)
+		if got := openaiImageTokens(url, tc.detail); got != tc.want {
+			t.Errorf("OpenAI %dx%d %s: got %d tokens, want %d", tc.width, tc.height, tc.detail, got, tc.want)
+		}
+	}
+
+	if got := openaiImageTokens("https://example.com/cat.png", "auto"); got != openaiMaxImageTokens {
+		t.Errorf("OpenAI image of unknown size: got %d tokens, want %d", got, openaiMaxImageTokens)
+	}
+}
+
+func BenchmarkGetEncoding(b *testing.B) {
+	requireEncoding(b)
+	encoding := EncodingForModel(benchModel)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := tiktoken.GetEncoding(encoding); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := getEncoder(encoding); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkStreamOutput compares counting the output of a stream by
+// re-tokenizing everything received so far, which is what a running count
+// costs without incremental counting, with the OutputCounter. The ns/delta
+// metric grows with the stream length for the former and stays flat for the
+// latter.
+func BenchmarkStreamOutput(b *testing.B) {
+	requireEncoding(b)
+
+	for _, n := range []int{100, 1000} {
+		deltas := streamDeltas(n)
+
+		b.Run(fmt.Sprintf("recount/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var output strings.Builder
+				for _, delta := range deltas {
+					output.WriteString(delta)
+					if _, err := CountTokens(output.String(), benchModel); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/delta")
+		})
+
+		b.Run(fmt.Sprintf("incremental/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				counter := NewOutputCounter(benchModel)
+				for _, delta := range deltas {
+					counter.Add(delta)
+				}
+				if _, err := counter.Total(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/delta")
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package token_counter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Tokenizer maps the models whose names start with Prefix to an encoding
+type Tokenizer struct {
+	Prefix   string `json:"prefix"`
+	Encoding string `json:"encoding"`
+}
+
+// defaultTokenizer is used for models no tokenizer matches, including Claude
+// whose tokenizer is not public
+var defaultTokenizer = Tokenizer{Encoding: tiktoken.MODEL_CL100K_BASE}
+
+// builtinTokenizers covers the OpenAI model families
+var builtinTokenizers = []Tokenizer{
+	{Prefix: "gpt-4o", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "chatgpt-4o", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "gpt-4.1", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "gpt-4.5", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "gpt-5", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "o1", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "o3", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "o4", Encoding: tiktoken.MODEL_O200K_BASE},
+	{Prefix: "gpt-4", Encoding: tiktoken.MODEL_CL100K_BASE},
+	{Prefix: "gpt-3.5-turbo", Encoding: tiktoken.MODEL_CL100K_BASE},
+	{Prefix: "text-embedding-3", Encoding: tiktoken.MODEL_CL100K_BASE},
+	{Prefix: "text-embedding-ada-002", Encoding: tiktoken.MODEL_CL100K_BASE},
+}
+
+// knownEncodings are the encodings tiktoken can load
+var knownEncodings = map[string]bool{
+	tiktoken.MODEL_O200K_BASE:  true,
+	tiktoken.MODEL_CL100K_BASE: true,
+	tiktoken.MODEL_P50K_BASE:   true,
+	tiktoken.MODEL_P50K_EDIT:   true,
+	tiktoken.MODEL_R50K_BASE:   true,
+}
+
+var (
+	tokenizersMu sync.RWMutex
+	configured   []Tokenizer // Checked before the built-in tokenizers
+)
+
+// ValidateTokenizer checks that a configured tokenizer is usable
+func ValidateTokenizer(t Tokenizer) error {
+	if t.Prefix == "" {
+		return fmt.Errorf("tokenizer without a prefix")
+	}
+	if !knownEncodings[t.Encoding] {
+		return fmt.Errorf("tokenizer %q has unknown encoding %q", t.Prefix, t.Encoding)
+	}
+	return nil
+}
+
+// SetTokenizers registers tokenizers from the configuration. They take
+// precedence over the built-in ones.
+func SetTokenizers(tokenizers []Tokenizer) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+
+	configured = make([]Tokenizer, len(tokenizers))
+	for i, t := range tokenizers {
+		t.Prefix = strings.ToLower(t.Prefix)
+		configured[i] = t
+	}
+}
+
+// TokenizerForModel returns the tokenizer for a model. Provider prefixes
+// such as "openai/" are ignored and the longest matching prefix wins.
+func TokenizerForModel(model string) Tokenizer {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	tokenizersMu.RLock()
+	defer tokenizersMu.RUnlock()
+
+	if t, ok := longestPrefix(configured, name); ok {
+		return t
+	}
+	if t, ok := longestPrefix(builtinTokenizers, name); ok {
+		return t
+	}
+	return defaultTokenizer
+}
+
+func longestPrefix(tokenizers []Tokenizer, name string) (Tokenizer, bool) {
+	var best Tokenizer
+	found := false
+	for _, t := range tokenizers {
+		if strings.HasPrefix(name, t.Prefix) && (!found || len(t.Prefix) > len(best.Prefix)) {
+			best = t
+			found = true
+		}
+	}
+	return best, found
+}
+
+// LoadEncodings loads the encodings of the default, built-in and configured
+// tokenizers, so that a missing one is reported at startup rather than on
+// the first request that needs it
+func LoadEncodings() error {
+	tokenizersMu.RLock()
+	encodings := []string{defaultTokenizer.Encoding}
+	for _, t := range append(append([]Tokenizer{}, builtinTokenizers...), configured...) {
+		encodings = append(encodings, t.Encoding)
+	}
+	tokenizersMu.RUnlock()
+
+	loaded := make(map[string]bool)
+	for _, encoding := range encodings {
+		if loaded[encoding] {
+			continue
+		}
+		if _, err := getEncoder(encoding); err != nil {
+			return fmt.Errorf("encoding %s is not available: %v", encoding, err)
+		}
+		loaded[encoding] = true
+	}
+	return nil
+}